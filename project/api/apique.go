@@ -1,104 +1,271 @@
 package apiqueue
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// RequestPriority описывает приоритет запроса
-type RequestPriority int
+// CanceledError возвращается, если контекст задачи отменён раньше, чем пришёл ответ.
+// Stage показывает, на каком этапе задача была снята: в очереди или во время запроса.
+type CanceledError struct {
+	Stage string
+	Err   error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("apiqueue: задача отменена (%s): %v", e.Stage, e.Err)
+}
+
+// Unwrap позволяет проверять context.Canceled / context.DeadlineExceeded через errors.Is
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
 
 const (
-	Low RequestPriority = iota
-	High
+	StageEnqueue = "enqueue" // очередь переполнена, задача не попала в неё
+	StageQueued  = "queued"  // задача ждала своей очереди
+	StageRequest = "request" // запрос уже выполнялся
 )
 
+// taskResult — ответ воркера на одну задачу
+type taskResult struct {
+	resp *http.Response
+	err  error
+}
+
 // RequestTask описывает задачу запроса к API
 type RequestTask struct {
+	Ctx      context.Context
 	Req      *http.Request
 	Priority RequestPriority
-	Response chan *http.Response
-	Error    chan error
+
+	retry      RetryPolicy
+	attempt    int
+	enqueuedAt time.Time
+	// sent — запрос хотя бы раз ушёл в сеть (в том числе до повтора)
+	sent atomic.Bool
+
+	// result буферизован на одно значение: воркер всегда отправляет ровно один
+	// результат и никогда не блокируется, даже если вызывающий уже ушёл
+	result chan taskResult
 }
 
-// ApiQueue — очередь с приоритетом
+// ApiQueue — очередь с приоритетом.
+// Для каждого хоста заводится своя пара очередей и свой лимитер,
+// поэтому запросы к разным API не тормозят друг друга.
 type ApiQueue struct {
-	highTasks chan *RequestTask
-	lowTasks  chan *RequestTask
-	interval  time.Duration
+	mu           sync.Mutex
+	client       *http.Client
+	queueSize    int
+	agingStep    time.Duration
+	defaultLimit HostLimit
+	limits       map[string]HostLimit
+	hosts        map[string]*hostQueue
+	shared       SharedLimiter
+	closed       bool
+}
+
+// hostQueue — очередь по классам приоритета, лимитер и breaker одного хоста
+type hostQueue struct {
+	host    string
+	pending *pendingQueue
+	limit   HostLimit
+	limiter *tokenBucket
+	breaker *breaker
 }
 
 // глобальная очередь
 var Queue *ApiQueue
 
-// InitPriorityQueue инициализирует глобальную очередь с приоритетами
-func InitPriorityQueue(highSize, lowSize int, interval time.Duration) {
+// ErrQueueClosed возвращается при постановке задачи в закрытую очередь
+var ErrQueueClosed = errors.New("apiqueue: очередь закрыта")
+
+// InitPriorityQueue инициализирует глобальную очередь с приоритетами.
+// queueSize — ёмкость каждого класса приоритета на хост,
+// interval — лимит по умолчанию для хостов без своей настройки.
+func InitPriorityQueue(queueSize int, interval time.Duration) {
 	if Queue == nil {
 		Queue = &ApiQueue{
-			highTasks: make(chan *RequestTask, highSize),
-			lowTasks:  make(chan *RequestTask, lowSize),
-			interval:  interval,
+			client:       &http.Client{},
+			queueSize:    queueSize,
+			agingStep:    DefaultAgingStep,
+			defaultLimit: HostLimit{Interval: interval, Burst: 1},
+			limits:       make(map[string]HostLimit),
+			hosts:        make(map[string]*hostQueue),
 		}
-		go Queue.startWorker()
 	}
 }
 
-// startWorker выполняет задачи с приоритетом
-func (q *ApiQueue) startWorker() {
-	client := &http.Client{}
-	ticker := time.NewTicker(q.interval)
-	defer ticker.Stop()
+// SetHostLimit задаёт отдельный лимит для хоста.
+// Если очередь хоста уже создана, лимитер заменяется на новый.
+func (q *ApiQueue) SetHostLimit(host string, limit HostLimit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limits[host] = limit
+	if hq, ok := q.hosts[host]; ok {
+		hq.limit = limit
+		hq.limiter = newTokenBucket(limit)
+	}
+}
+
+// hostQueueFor возвращает очередь хоста, создавая её и воркер при первом обращении
+func (q *ApiQueue) hostQueueFor(host string) (*hostQueue, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	if hq, ok := q.hosts[host]; ok {
+		return hq, nil
+	}
+
+	limit, ok := q.limits[host]
+	if !ok {
+		limit = q.defaultLimit
+	}
+	hq := &hostQueue{
+		host:    host,
+		pending: newPendingQueue(q.queueSize, q.agingStep),
+		limit:   limit,
+		limiter: newTokenBucket(limit),
+		breaker: newBreaker(host, DefaultBreakerConfig),
+	}
+	q.hosts[host] = hq
+	go q.startWorker(hq)
+	return hq, nil
+}
+
+// limiterFor читает текущий лимитер хоста под мьютексом (SetHostLimit может его заменить)
+func (q *ApiQueue) limiterFor(hq *hostQueue) *tokenBucket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return hq.limiter
+}
 
+// startWorker выполняет задачи одного хоста с приоритетом
+func (q *ApiQueue) startWorker(hq *hostQueue) {
 	for {
-		var task *RequestTask
-		select {
-		case task = <-q.highTasks: // сначала high priority
-		default:
-			select {
-			case task = <-q.highTasks:
-			case task = <-q.lowTasks:
-			}
+		task, ok := hq.pending.pop()
+		if !ok {
+			return // очередь закрыта
 		}
 
-		if task == nil {
+		// отменённые задачи не тратят токен лимитера
+		if err := task.Ctx.Err(); err != nil {
+			task.result <- taskResult{err: &CanceledError{Stage: StageQueued, Err: err}}
 			continue
 		}
 
-		<-ticker.C
+		// пока хост лежит, задачи из очереди тоже отклоняются сразу
+		if err := hq.breaker.allow(true); err != nil {
+			task.result <- taskResult{err: err}
+			continue
+		}
 
-		resp, err := client.Do(task.Req)
-		if err != nil {
-			task.Error <- err
-		} else {
-			task.Response <- resp
+		if err := q.limiterFor(hq).Wait(task.Ctx); err != nil {
+			hq.breaker.release()
+			task.result <- taskResult{err: &CanceledError{Stage: StageQueued, Err: err}}
+			continue
+		}
+
+		// общий бюджет на все реплики, если он настроен
+		if err := q.waitShared(task.Ctx, hq); err != nil {
+			hq.breaker.release()
+			task.result <- taskResult{err: &CanceledError{Stage: StageQueued, Err: err}}
+			continue
+		}
+
+		task.sent.Store(true)
+		resp, err := q.client.Do(task.Req)
+		if err != nil && task.Ctx.Err() != nil {
+			hq.breaker.release()
+			task.result <- taskResult{err: &CanceledError{Stage: StageRequest, Err: task.Ctx.Err()}}
+			continue
+		}
+		hq.breaker.record(resp, err)
+
+		// 429 и 5xx уходят на повтор с backoff, пока не кончится бюджет
+		if requeued, res := q.handleRetry(hq, task, resp, err); !requeued {
+			task.result <- res
 		}
-		close(task.Response)
-		close(task.Error)
 	}
 }
 
-// Enqueue добавляет запрос в очередь с указанным приоритетом
+// Enqueue добавляет запрос в очередь с указанным приоритетом.
+// Ожидание ограничено контекстом самого запроса.
 func (q *ApiQueue) Enqueue(req *http.Request, priority RequestPriority) (*http.Response, error) {
+	return q.EnqueueContext(req.Context(), req, priority)
+}
+
+// EnqueueContext добавляет запрос в очередь и ждёт ответа, пока жив ctx.
+// При отмене ctx задача снимается с очереди и возвращается *CanceledError.
+func (q *ApiQueue) EnqueueContext(ctx context.Context, req *http.Request, priority RequestPriority) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &CanceledError{Stage: StageEnqueue, Err: err}
+	}
+
 	task := &RequestTask{
-		Req:      req,
+		Ctx:      ctx,
+		Req:      req.WithContext(ctx),
 		Priority: priority,
-		Response: make(chan *http.Response),
-		Error:    make(chan error),
+		retry:    retryPolicyFrom(ctx),
+		result:   make(chan taskResult, 1),
+	}
+
+	hq, err := q.hostQueueFor(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if err := hq.breaker.allow(false); err != nil {
+		return nil, err
 	}
 
-	if priority == High {
-		q.highTasks <- task
-	} else {
-		q.lowTasks <- task
+	if err := hq.pending.push(ctx, task); err != nil {
+		if errors.Is(err, ErrQueueClosed) {
+			return nil, err
+		}
+		return nil, &CanceledError{Stage: StageEnqueue, Err: err}
 	}
 
-	resp := <-task.Response
-	err := <-task.Error
-	return resp, err
+	select {
+	case res := <-task.result:
+		return res.resp, res.err
+	case <-ctx.Done():
+		// задача ещё в очереди (впервые или ждёт повтора) — просто убираем её
+		removed := hq.pending.remove(task)
+		if !removed {
+			// воркер всё равно пришлёт результат — закрываем тело, чтобы не держать соединение
+			go func() {
+				if res := <-task.result; res.resp != nil {
+					res.resp.Body.Close()
+				}
+			}()
+		}
+		// запрос уже уходил в сеть: отправлен и брошен, а не «не отправлен»
+		if task.sent.Load() {
+			return nil, &CanceledError{Stage: StageRequest, Err: ctx.Err()}
+		}
+		return nil, &CanceledError{Stage: StageQueued, Err: ctx.Err()}
+	}
 }
 
-// Close закрывает очередь
+// Close закрывает очереди всех хостов
 func (q *ApiQueue) Close() {
-	close(q.highTasks)
-	close(q.lowTasks)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for _, hq := range q.hosts {
+		hq.pending.close()
+	}
 }
@@ -0,0 +1,107 @@
+package apiqueue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestQueue — очередь без глобального состояния; без лимита, если limit нулевой
+func newTestQueue(t *testing.T, limit HostLimit) *ApiQueue {
+	t.Helper()
+	q := &ApiQueue{
+		client:       &http.Client{},
+		queueSize:    10,
+		agingStep:    DefaultAgingStep,
+		defaultLimit: limit,
+		limits:       make(map[string]HostLimit),
+		hosts:        make(map[string]*hostQueue),
+	}
+	t.Cleanup(q.Close)
+	return q
+}
+
+// testServer считает запросы; block, если не nil, задерживает ответ до закрытия канала
+type testServer struct {
+	*httptest.Server
+	hits    atomic.Int32
+	arrived chan struct{}
+}
+
+func newTestServer(t *testing.T, block chan struct{}, status func(hit int32) int) *testServer {
+	t.Helper()
+	s := &testServer{arrived: make(chan struct{}, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit := s.hits.Add(1)
+		s.arrived <- struct{}{}
+		if block != nil {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}
+		w.WriteHeader(status(hit))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func statusOK(int32) int { return http.StatusOK }
+
+func get(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// waitArrived ждёт, пока запрос дойдёт до сервера
+func waitArrived(t *testing.T, s *testServer) {
+	t.Helper()
+	select {
+	case <-s.arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("запрос не дошёл до сервера")
+	}
+}
+
+func TestEnqueueCancelStages(t *testing.T) {
+	release := make(chan struct{})
+	srv := newTestServer(t, release, statusOK)
+	q := newTestQueue(t, HostLimit{})
+
+	// первая задача занимает воркер хоста запросом, вторая ждёт в очереди
+	inflightCtx, cancelInflight := context.WithCancel(context.Background())
+	inflight := make(chan error, 1)
+	go func() {
+		_, err := q.EnqueueContext(inflightCtx, get(t, srv.URL), Interactive)
+		inflight <- err
+	}()
+	waitArrived(t, srv)
+
+	queuedCtx, cancelQueued := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelQueued()
+	_, err := q.EnqueueContext(queuedCtx, get(t, srv.URL), Interactive)
+	var ce *CanceledError
+	if !errors.As(err, &ce) || ce.Stage != StageQueued || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("задача из очереди: %v, ожидалась отмена на этапе %s", err, StageQueued)
+	}
+
+	cancelInflight()
+	if err := <-inflight; !errors.As(err, &ce) || ce.Stage != StageRequest {
+		t.Fatalf("задача в полёте: %v, ожидалась отмена на этапе %s", err, StageRequest)
+	}
+	close(release)
+
+	// снятая с очереди задача так и не ушла в сеть
+	time.Sleep(50 * time.Millisecond)
+	if n := srv.hits.Load(); n != 1 {
+		t.Errorf("запросов на сервере %d, ожидался один", n)
+	}
+}
@@ -0,0 +1,139 @@
+package apiqueue
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerState — состояние circuit breaker хоста
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // запросы идут как обычно
+	BreakerOpen                         // хост недоступен, запросы сразу отклоняются
+	BreakerHalfOpen                     // пропускаем одну пробную задачу
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig — после Threshold неудач подряд breaker открывается на Cooldown
+type BreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// DefaultBreakerConfig — настройки breaker для всех хостов
+var DefaultBreakerConfig = BreakerConfig{
+	Threshold: 5,
+	Cooldown:  30 * time.Second,
+}
+
+// CircuitOpenError возвращается без обращения к сети, пока breaker хоста открыт
+type CircuitOpenError struct {
+	Host    string
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("apiqueue: %s недоступен, повтор после %s", e.Host, e.RetryAt.Format("15:04:05"))
+}
+
+// breaker — circuit breaker одного хоста
+type breaker struct {
+	mu       sync.Mutex
+	host     string
+	cfg      BreakerConfig
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(host string, cfg BreakerConfig) *breaker {
+	return &breaker{host: host, cfg: cfg}
+}
+
+// allow решает, можно ли выполнить запрос прямо сейчас.
+// probe=true значит, что вызывающий занимает единственный слот half-open.
+func (b *breaker) allow(probe bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		retryAt := b.openedAt.Add(b.cfg.Cooldown)
+		if time.Now().Before(retryAt) {
+			return &CircuitOpenError{Host: b.host, RetryAt: retryAt}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = false
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{Host: b.host, RetryAt: time.Now().Add(b.cfg.Cooldown)}
+		}
+		if probe {
+			b.probing = true
+		}
+	}
+	return nil
+}
+
+// record учитывает результат запроса
+func (b *breaker) record(resp *http.Response, err error) {
+	failed := err != nil || resp.StatusCode >= 500
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.cfg.Threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// release освобождает слот пробы, если задача не дошла до сети
+func (b *breaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// BreakerState возвращает состояние breaker хоста; для неизвестного хоста — closed
+func (q *ApiQueue) BreakerState(host string) BreakerState {
+	q.mu.Lock()
+	hq, ok := q.hosts[host]
+	q.mu.Unlock()
+	if !ok {
+		return BreakerClosed
+	}
+	return hq.breaker.State()
+}
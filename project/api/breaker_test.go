@@ -0,0 +1,82 @@
+package apiqueue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAndProbesOnce(t *testing.T) {
+	prev := DefaultBreakerConfig
+	DefaultBreakerConfig = BreakerConfig{Threshold: 2, Cooldown: 100 * time.Millisecond}
+	t.Cleanup(func() { DefaultBreakerConfig = prev })
+
+	var healthy atomic.Bool
+	release := make(chan struct{})
+	var blockProbe atomic.Bool
+	srv := newTestServer(t, nil, func(int32) int {
+		if blockProbe.Load() {
+			<-release
+		}
+		if healthy.Load() {
+			return http.StatusOK
+		}
+		return http.StatusInternalServerError
+	})
+	q := newTestQueue(t, HostLimit{})
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{MaxAttempts: 1})
+	host := srv.Listener.Addr().String()
+
+	for i := 0; i < 2; i++ {
+		resp, err := q.EnqueueContext(ctx, get(t, srv.URL), Interactive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if state := q.BreakerState(host); state != BreakerOpen {
+		t.Fatalf("breaker %s после двух 500, ожидался open", state)
+	}
+
+	// пока breaker открыт, запрос отклоняется сразу и не доходит до сервера
+	start := time.Now()
+	_, err := q.EnqueueContext(ctx, get(t, srv.URL), Interactive)
+	var open *CircuitOpenError
+	if !errors.As(err, &open) || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("открытый breaker: %v за %s", err, time.Since(start))
+	}
+	if n := srv.hits.Load(); n != 2 {
+		t.Fatalf("запросов на сервере %d, ожидалось 2", n)
+	}
+
+	// после паузы пропускается одна проба; остальные ждут её исхода
+	time.Sleep(DefaultBreakerConfig.Cooldown)
+	healthy.Store(true)
+	blockProbe.Store(true)
+	probe := make(chan error, 1)
+	probeReq := get(t, srv.URL)
+	go func() {
+		resp, err := q.EnqueueContext(ctx, probeReq, Interactive)
+		if err == nil {
+			resp.Body.Close()
+		}
+		probe <- err
+	}()
+	waitArrived(t, srv) // первые два запроса
+	waitArrived(t, srv)
+	waitArrived(t, srv) // проба
+	if _, err := q.EnqueueContext(ctx, get(t, srv.URL), Interactive); !errors.As(err, &open) {
+		t.Fatalf("запрос во время пробы: %v, ожидался отказ", err)
+	}
+	blockProbe.Store(false)
+	close(release)
+	if err := <-probe; err != nil {
+		t.Fatalf("проба: %v", err)
+	}
+	if state := q.BreakerState(host); state != BreakerClosed {
+		t.Errorf("breaker %s после удачной пробы, ожидался closed", state)
+	}
+}
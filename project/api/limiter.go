@@ -0,0 +1,129 @@
+package apiqueue
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HostLimit описывает лимит запросов к одному хосту:
+// один запрос раз в Interval, с запасом до Burst запросов подряд
+type HostLimit struct {
+	Interval time.Duration
+	Burst    int
+}
+
+// tokenBucket — простой token bucket: токен восстанавливается раз в interval,
+// в ведре помещается не больше burst токенов
+type tokenBucket struct {
+	mu       sync.Mutex
+	base     time.Duration // настроенный интервал
+	interval time.Duration // текущий интервал, растёт после 429
+	burst    float64
+	tokens   float64
+	last     time.Time
+	paused   time.Time // до этого момента токены не выдаются (Retry-After)
+}
+
+// maxSlowdown — во сколько раз максимум замедляемся после серии 429
+const maxSlowdown = 8
+
+func newTokenBucket(limit HostLimit) *tokenBucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{
+		base:     limit.Interval,
+		interval: limit.Interval,
+		burst:    float64(limit.Burst),
+		tokens:   float64(limit.Burst),
+		last:     time.Now(),
+	}
+}
+
+// reserve забирает токен и возвращает, сколько нужно подождать до его появления
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.interval <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens * float64(b.interval))
+	}
+	if pause := b.paused.Sub(now); pause > delay {
+		delay = pause
+	}
+	return delay
+}
+
+// slowDown вызывается после 429: удваивает интервал и, если сервер
+// прислал Retry-After, не выдаёт токены до его истечения
+func (b *tokenBucket) slowDown(retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.base <= 0 {
+		return
+	}
+	b.interval *= 2
+	if limit := b.base * maxSlowdown; b.interval > limit {
+		b.interval = limit
+	}
+	b.tokens = 0
+	if retryAfter > 0 {
+		if until := time.Now().Add(retryAfter); until.After(b.paused) {
+			b.paused = until
+		}
+	}
+}
+
+// speedUp после успешного ответа понемногу возвращает интервал к настроенному
+func (b *tokenBucket) speedUp() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.interval > b.base {
+		b.interval -= (b.interval - b.base) / 10
+		if b.interval-b.base < time.Millisecond {
+			b.interval = b.base
+		}
+	}
+}
+
+// cancel возвращает токен, если ожидание было прервано
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// Wait ждёт свободный токен или отмену ctx
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	delay := b.reserve()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
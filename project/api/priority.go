@@ -0,0 +1,269 @@
+package apiqueue
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestPriority — класс приоритета запроса: чем больше значение, тем раньше
+// задача уходит в сеть. Допустимо любое неотрицательное значение, именованные
+// классы ниже покрывают то, что есть в боте.
+type RequestPriority int
+
+const (
+	Backfill    RequestPriority = iota // догрузка старой истории
+	Indexer                            // регулярная индексация
+	Notifier                           // уведомления о продажах
+	Interactive                        // ответы на команды пользователей
+)
+
+func (p RequestPriority) String() string {
+	switch p {
+	case Backfill:
+		return "backfill"
+	case Indexer:
+		return "indexer"
+	case Notifier:
+		return "notifier"
+	case Interactive:
+		return "interactive"
+	default:
+		return "class-" + strconv.Itoa(int(p))
+	}
+}
+
+// DefaultAgingStep — каждые AgingStep ожидания поднимают задачу на один класс,
+// поэтому поток срочных задач не может навсегда задержать фоновые
+var DefaultAgingStep = 30 * time.Second
+
+// ClassStats — статистика одного класса приоритета на одном хосте
+type ClassStats struct {
+	Priority RequestPriority
+	Depth    int           // задач ждёт сейчас
+	Dequeued uint64        // задач взято в работу
+	Promoted uint64        // из них взято раньше более приоритетных благодаря aging
+	AvgWait  time.Duration // среднее ожидание в очереди
+	MaxWait  time.Duration // максимальное ожидание в очереди
+}
+
+type classCounters struct {
+	dequeued  uint64
+	promoted  uint64
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+// pendingQueue — FIFO на каждый класс приоритета одного хоста
+type pendingQueue struct {
+	mu       sync.Mutex
+	capacity int
+	aging    time.Duration
+	classes  map[RequestPriority][]*RequestTask
+	counters map[RequestPriority]*classCounters
+	wake     chan struct{} // будит воркер, буфер на одно значение
+	space    chan struct{} // закрывается, когда в очереди освобождается место
+	closed   bool
+}
+
+func newPendingQueue(capacity int, aging time.Duration) *pendingQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &pendingQueue{
+		capacity: capacity,
+		aging:    aging,
+		classes:  make(map[RequestPriority][]*RequestTask),
+		counters: make(map[RequestPriority]*classCounters),
+		wake:     make(chan struct{}, 1),
+		space:    make(chan struct{}),
+	}
+}
+
+// push ставит задачу в очередь её класса; если класс заполнен, ждёт места или отмены ctx
+func (pq *pendingQueue) push(ctx context.Context, task *RequestTask) error {
+	for {
+		pq.mu.Lock()
+		if pq.closed {
+			pq.mu.Unlock()
+			return ErrQueueClosed
+		}
+		if len(pq.classes[task.Priority]) < pq.capacity {
+			task.enqueuedAt = time.Now()
+			pq.classes[task.Priority] = append(pq.classes[task.Priority], task)
+			select {
+			case pq.wake <- struct{}{}:
+			default:
+			}
+			pq.mu.Unlock()
+			return nil
+		}
+		space := pq.space
+		pq.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pop блокируется до появления задачи; false — очередь закрыта и пуста
+func (pq *pendingQueue) pop() (*RequestTask, bool) {
+	for {
+		pq.mu.Lock()
+		if task := pq.next(time.Now()); task != nil {
+			pq.mu.Unlock()
+			return task, true
+		}
+		if pq.closed {
+			pq.mu.Unlock()
+			return nil, false
+		}
+		pq.mu.Unlock()
+
+		<-pq.wake
+	}
+}
+
+// next выбирает задачу с наибольшим эффективным приоритетом:
+// класс задачи плюс по одному за каждый AgingStep ожидания.
+// Внутри класса порядок FIFO, поэтому достаточно смотреть на головы очередей.
+func (pq *pendingQueue) next(now time.Time) *RequestTask {
+	var (
+		best        RequestPriority
+		bestScore   int64
+		found       bool
+		topPriority RequestPriority
+	)
+	for p, tasks := range pq.classes {
+		if len(tasks) == 0 {
+			continue
+		}
+		head := tasks[0]
+		score := int64(p)
+		if pq.aging > 0 {
+			score += int64(now.Sub(head.enqueuedAt) / pq.aging)
+		}
+		if !found || p > topPriority {
+			topPriority = p
+		}
+		if !found || score > bestScore ||
+			(score == bestScore && p > best) {
+			best, bestScore, found = p, score, true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	tasks := pq.classes[best]
+	task := tasks[0]
+	tasks[0] = nil
+	pq.classes[best] = tasks[1:]
+
+	c := pq.counter(best)
+	wait := now.Sub(task.enqueuedAt)
+	c.dequeued++
+	c.totalWait += wait
+	if wait > c.maxWait {
+		c.maxWait = wait
+	}
+	if best < topPriority {
+		c.promoted++
+	}
+
+	pq.signalSpace()
+	return task
+}
+
+// remove снимает задачу с очереди; false — воркер её уже забрал
+func (pq *pendingQueue) remove(task *RequestTask) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	tasks := pq.classes[task.Priority]
+	for i, t := range tasks {
+		if t == task {
+			pq.classes[task.Priority] = append(tasks[:i], tasks[i+1:]...)
+			pq.signalSpace()
+			return true
+		}
+	}
+	return false
+}
+
+// signalSpace будит всех, кто ждёт места; вызывается под мьютексом
+func (pq *pendingQueue) signalSpace() {
+	close(pq.space)
+	pq.space = make(chan struct{})
+}
+
+func (pq *pendingQueue) counter(p RequestPriority) *classCounters {
+	c, ok := pq.counters[p]
+	if !ok {
+		c = &classCounters{}
+		pq.counters[p] = c
+	}
+	return c
+}
+
+func (pq *pendingQueue) close() {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if pq.closed {
+		return
+	}
+	pq.closed = true
+	close(pq.wake)
+}
+
+// stats возвращает статистику по всем классам, которые встречались, от старшего к младшему
+func (pq *pendingQueue) stats() []ClassStats {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	seen := make(map[RequestPriority]bool)
+	for p := range pq.classes {
+		seen[p] = true
+	}
+	for p := range pq.counters {
+		seen[p] = true
+	}
+
+	out := make([]ClassStats, 0, len(seen))
+	for p := range seen {
+		st := ClassStats{Priority: p, Depth: len(pq.classes[p])}
+		if c, ok := pq.counters[p]; ok {
+			st.Dequeued = c.dequeued
+			st.Promoted = c.promoted
+			st.MaxWait = c.maxWait
+			if c.dequeued > 0 {
+				st.AvgWait = c.totalWait / time.Duration(c.dequeued)
+			}
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Priority > out[j].Priority })
+	return out
+}
+
+// Stats возвращает статистику очереди по хостам и классам приоритета
+func (q *ApiQueue) Stats() map[string][]ClassStats {
+	q.mu.Lock()
+	hosts := make(map[string]*hostQueue, len(q.hosts))
+	for h, hq := range q.hosts {
+		hosts[h] = hq
+	}
+	q.mu.Unlock()
+
+	out := make(map[string][]ClassStats, len(hosts))
+	for h, hq := range hosts {
+		out[h] = hq.pending.stats()
+	}
+	return out
+}
@@ -0,0 +1,45 @@
+package apiqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestAgingPromotesUnderLoad — фоновая задача уходит в работу, хотя срочные
+// задачи поступают непрерывно: ожидание поднимает её класс
+func TestAgingPromotesUnderLoad(t *testing.T) {
+	const aging = 10 * time.Millisecond
+	pq := newPendingQueue(10, aging)
+	ctx := context.Background()
+
+	low := &RequestTask{Priority: Backfill}
+	if err := pq.push(ctx, low); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for served := 0; ; served++ {
+		if err := pq.push(ctx, &RequestTask{Priority: Interactive}); err != nil {
+			t.Fatal(err)
+		}
+		task, _ := pq.pop()
+		if task == low {
+			// обогнать три класса можно не раньше, чем через три шага aging
+			if wait := time.Since(low.enqueuedAt); wait < 3*aging {
+				t.Errorf("фоновая задача взята через %s, раньше aging", wait)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("фоновая задача не взята за секунду, срочных обслужено %d", served)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, st := range pq.stats() {
+		if st.Priority == Backfill && (st.Dequeued != 1 || st.Promoted != 1) {
+			t.Errorf("статистика фонового класса %+v, ожидалось взято 1, продвинуто 1", st)
+		}
+	}
+}
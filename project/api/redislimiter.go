@@ -0,0 +1,113 @@
+package apiqueue
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// SharedLimiter — лимитер, общий для нескольких экземпляров бота.
+// Reserve возвращает 0, если запрос к host можно выполнить сейчас,
+// иначе — сколько подождать до следующей попытки.
+type SharedLimiter interface {
+	Reserve(ctx context.Context, host string, limit HostLimit) (time.Duration, error)
+}
+
+// gcraScript — GCRA на стороне Redis. Время берём из самого Redis,
+// чтобы расхождение часов между репликами не влияло на лимит.
+// KEYS[1] — TAT хоста, ARGV[1] — интервал в мс, ARGV[2] — burst.
+// Возвращает 0, если запрос разрешён, иначе задержку в мс.
+var gcraScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local tolerance = interval * (burst - 1)
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local allowAt = tat - tolerance
+if now < allowAt then
+	return allowAt - now
+end
+
+local newTat = tat + interval
+redis.call('SET', KEYS[1], newTat, 'PX', newTat - now + tolerance + 1000)
+return 0
+`)
+
+// RedisLimiter — SharedLimiter поверх Redis (GCRA)
+type RedisLimiter struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// NewRedisLimiter создаёт общий лимитер; ключи вида <prefix><host>
+func NewRedisLimiter(rdb *redis.Client, prefix string) *RedisLimiter {
+	if prefix == "" {
+		prefix = "ratelimit:"
+	}
+	return &RedisLimiter{rdb: rdb, prefix: prefix}
+}
+
+func (l *RedisLimiter) Reserve(ctx context.Context, host string, limit HostLimit) (time.Duration, error) {
+	if limit.Interval <= 0 {
+		return 0, nil
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	ms, err := gcraScript.Run(ctx, l.rdb, []string{l.prefix + host},
+		limit.Interval.Milliseconds(), burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// SetSharedLimiter включает общий лимитер поверх локальных; nil выключает его
+func (q *ApiQueue) SetSharedLimiter(l SharedLimiter) {
+	q.mu.Lock()
+	q.shared = l
+	q.mu.Unlock()
+}
+
+// waitShared ждёт разрешения общего лимитера. Если он недоступен,
+// запрос идёт только под локальным лимитом, чтобы сбой Redis не останавливал бота.
+func (q *ApiQueue) waitShared(ctx context.Context, hq *hostQueue) error {
+	q.mu.Lock()
+	shared, limit := q.shared, hq.limit
+	q.mu.Unlock()
+	if shared == nil {
+		return nil
+	}
+
+	for {
+		delay, err := shared.Reserve(ctx, hq.host, limit)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("[ApiQueue] общий лимитер недоступен для %s, используем локальный: %v", hq.host, err)
+			return nil
+		}
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
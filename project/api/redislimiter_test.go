@@ -0,0 +1,38 @@
+package apiqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRedisLimiterGCRA(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ctx := context.Background()
+	limit := HostLimit{Interval: time.Minute, Burst: 2}
+
+	// две реплики делят один бюджет: burst запросов сразу, следующий — через интервал
+	a, b := NewRedisLimiter(rdb, "rl:"), NewRedisLimiter(rdb, "rl:")
+	for i, l := range []*RedisLimiter{a, b} {
+		if delay, err := l.Reserve(ctx, "example.com", limit); err != nil || delay != 0 {
+			t.Fatalf("запрос %d: задержка %s (%v), ожидался сразу", i+1, delay, err)
+		}
+	}
+	delay, err := a.Reserve(ctx, "example.com", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delay <= 0 || delay > limit.Interval {
+		t.Errorf("третий запрос: задержка %s, ожидалось до %s", delay, limit.Interval)
+	}
+
+	// у другого хоста свой бюджет
+	if delay, _ := a.Reserve(ctx, "other.com", limit); delay != 0 {
+		t.Errorf("другой хост: задержка %s", delay)
+	}
+}
@@ -0,0 +1,185 @@
+package apiqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy описывает повторы одного запроса.
+// MaxAttempts — общий бюджет попыток, включая первую; 1 отключает повторы.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy — повторы по умолчанию для всех запросов очереди
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    time.Minute,
+}
+
+// RetryError возвращается, когда бюджет повторов исчерпан.
+// StatusCode — код последнего ответа (0, если ответа не было).
+type RetryError struct {
+	Attempts   int
+	StatusCode int
+	Err        error
+}
+
+func (e *RetryError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("apiqueue: %d попыток исчерпано: %v", e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("apiqueue: %d попыток исчерпано, последний статус %d", e.Attempts, e.StatusCode)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy задаёт свой бюджет повторов для запросов с этим контекстом
+func WithRetryPolicy(ctx context.Context, p RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, p)
+}
+
+func retryPolicyFrom(ctx context.Context) RetryPolicy {
+	if p, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok {
+		return p
+	}
+	return DefaultRetryPolicy
+}
+
+// isRetryable — повторяем только идемпотентные запросы и только временные ошибки
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoffDelay — экспоненциальная задержка с jitter: половина фиксирована, половина случайна
+func (p RetryPolicy) backoffDelay(attempt int) time.Duration {
+	d := p.BaseDelay << attempt
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half)
+}
+
+// parseRetryAfter разбирает заголовок Retry-After: секунды или HTTP-дата
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// discardBody дочитывает и закрывает тело, чтобы соединение вернулось в пул
+func discardBody(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+// handleRetry решает судьбу ответа: отдать вызывающему, повторить или вернуть RetryError.
+// Возвращает true, если задача снова поставлена в очередь.
+func (q *ApiQueue) handleRetry(hq *hostQueue, task *RequestTask, resp *http.Response, err error) (bool, taskResult) {
+	limiter := q.limiterFor(hq)
+
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		// сервер просит притормозить — замедляем весь хост, а не только эту задачу
+		wait, _ := parseRetryAfter(resp)
+		limiter.slowDown(wait)
+	} else if err == nil && resp.StatusCode < 500 {
+		limiter.speedUp()
+	}
+
+	if !isRetryable(task.Req, resp, err) {
+		return false, taskResult{resp: resp, err: err}
+	}
+
+	policy := task.retry
+	if policy.MaxAttempts <= 1 {
+		return false, taskResult{resp: resp, err: err}
+	}
+
+	task.attempt++
+	if task.attempt >= policy.MaxAttempts {
+		final := &RetryError{Attempts: task.attempt, Err: err}
+		if resp != nil {
+			final.StatusCode = resp.StatusCode
+		}
+		discardBody(resp)
+		return false, taskResult{err: final}
+	}
+
+	delay := policy.backoffDelay(task.attempt - 1)
+	if wait, ok := parseRetryAfter(resp); ok && wait > delay {
+		delay = wait
+	}
+	discardBody(resp)
+
+	go q.requeue(hq, task, delay)
+	return true, taskResult{}
+}
+
+// requeue возвращает задачу в очередь хоста после задержки
+func (q *ApiQueue) requeue(hq *hostQueue, task *RequestTask, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-task.Ctx.Done():
+		task.result <- taskResult{err: &CanceledError{Stage: StageQueued, Err: task.Ctx.Err()}}
+		return
+	}
+
+	if err := hq.pending.push(task.Ctx, task); err != nil {
+		if errors.Is(err, ErrQueueClosed) {
+			task.result <- taskResult{err: err}
+			return
+		}
+		task.result <- taskResult{err: &CanceledError{Stage: StageQueued, Err: err}}
+	}
+}
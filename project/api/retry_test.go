@@ -0,0 +1,63 @@
+package apiqueue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryUntilBudgetExhausted(t *testing.T) {
+	srv := newTestServer(t, nil, func(int32) int { return http.StatusServiceUnavailable })
+	q := newTestQueue(t, HostLimit{})
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    5 * time.Millisecond,
+	})
+
+	_, err := q.EnqueueContext(ctx, get(t, srv.URL), Indexer)
+	var re *RetryError
+	if !errors.As(err, &re) || re.Attempts != 3 || re.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("ошибка %v, ожидался RetryError после 3 попыток со статусом 503", err)
+	}
+	if n := srv.hits.Load(); n != 3 {
+		t.Errorf("запросов на сервере %d, ожидалось 3", n)
+	}
+}
+
+func TestRetryAfterSlowsHost(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+	q := newTestQueue(t, HostLimit{Interval: 10 * time.Millisecond, Burst: 1})
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{
+		MaxAttempts: 2,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    5 * time.Millisecond,
+	})
+
+	start := time.Now()
+	resp, err := q.EnqueueContext(ctx, get(t, srv.URL), Interactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("повтор через %s, а сервер просил подождать секунду", elapsed)
+	}
+
+	// после 429 замедляется весь хост, а не только повторённая задача
+	hq, _ := q.hostQueueFor(srv.Listener.Addr().String())
+	if interval := q.limiterFor(hq).interval; interval <= 10*time.Millisecond {
+		t.Errorf("интервал хоста %s, ожидалось замедление после 429", interval)
+	}
+}
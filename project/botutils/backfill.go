@@ -0,0 +1,169 @@
+package botutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/getgems"
+)
+
+const (
+	// backfillSlice — сколько первичный проход работает за один захват блокировки;
+	// между порциями индексатор подбирает новые события с головы истории
+	backfillSlice = time.Minute
+	// headPageSize — сколько последних событий смотрит опрос головы истории
+	headPageSize = 100
+)
+
+// BackfillProgress — прогресс первичного прохода истории коллекции
+type BackfillProgress struct {
+	Pages     int64 `json:"pages"`
+	Events    int64 `json:"events"`     // применено событий
+	FirstTS   int64 `json:"first_ts"`   // время самого старого события, мс
+	CurrentTS int64 `json:"current_ts"` // до какого события дошёл проход, мс
+	ActiveMs  int64 `json:"active_ms"`  // сколько проход уже проработал
+	HeadTS    int64 `json:"head_ts"`    // последнее событие, взятое с головы истории
+	Done      bool  `json:"done"`
+}
+
+// Percent — пройденная доля истории по времени событий, 0..100
+func (p BackfillProgress) Percent(now time.Time) int {
+	if p.Done {
+		return 100
+	}
+	total := now.UnixMilli() - p.FirstTS
+	if p.FirstTS == 0 || total <= 0 {
+		return 0
+	}
+	pct := int(100 * (p.CurrentTS - p.FirstTS) / total)
+	if pct > 99 {
+		pct = 99 // 100% — только когда проход действительно закончен
+	}
+	return pct
+}
+
+// ETA — оценка оставшегося времени по скорости прохода; 0 — оценить нельзя
+func (p BackfillProgress) ETA(now time.Time) time.Duration {
+	covered := float64(p.CurrentTS - p.FirstTS)
+	if p.Done || covered <= 0 || p.ActiveMs == 0 {
+		return 0
+	}
+	remaining := float64(now.UnixMilli() - p.CurrentTS)
+	return time.Duration(remaining / covered * float64(p.ActiveMs) * float64(time.Millisecond))
+}
+
+func (p BackfillProgress) String() string {
+	now := time.Now()
+	s := fmt.Sprintf("%d%%, страниц %d, событий %d", p.Percent(now), p.Pages, p.Events)
+	if p.CurrentTS > 0 {
+		s += ", дошли до " + time.UnixMilli(p.CurrentTS).Format("02.01.2006 15:04")
+	}
+	if eta := p.ETA(now); eta > 0 {
+		s += ", осталось ~" + eta.Round(time.Second).String()
+	}
+	return s
+}
+
+// backfillStep — одна порция первичного прохода: сначала новые события с головы
+// истории, затем не дольше backfillSlice старые с сохранённого курсора.
+// После перезапуска проход продолжается с курсора, прогресс — с последней страницы.
+func backfillStep(ctx context.Context, st Store, collectionAddress string) (more bool, err error) {
+	processName := "collection_indexing:" + collectionAddress
+
+	// голова истории — не повод бросать порцию: старые события догонят её позже
+	if err := pollHead(ctx, st, collectionAddress); err != nil {
+		log.Printf("[Backfill] %s: опрос новых событий: %v", collectionAddress, err)
+	}
+
+	prog, err := st.Backfill(ctx, collectionAddress)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("[Backfill] %s: порция с %s", collectionAddress, prog)
+
+	start := time.Now()
+	last := start
+	_, done, err := replayHistory(ctx, st, collectionAddress, apiqueue.Backfill, false, func(page historyPage) bool {
+		now := time.Now()
+		prog.Pages++
+		prog.Events += int64(page.Applied)
+		if prog.FirstTS == 0 {
+			prog.FirstTS = page.FirstTS
+		}
+		if page.LastTS > prog.CurrentTS {
+			prog.CurrentTS = page.LastTS
+		}
+		prog.ActiveMs += now.Sub(last).Milliseconds()
+		last = now
+
+		if err := st.SetBackfill(ctx, collectionAddress, prog); err != nil {
+			log.Printf("[Backfill] %s: сохранение прогресса: %v", collectionAddress, err)
+		}
+		st.SetStatus(ctx, processName, fmt.Sprintf("running:%d%%", prog.Percent(now)))
+		return now.Sub(start) < backfillSlice
+	})
+	if err != nil {
+		st.SetStatus(ctx, processName, "error")
+		return false, err
+	}
+	if !done {
+		return true, nil
+	}
+
+	prog.Done = true
+	if err := st.SetBackfill(ctx, collectionAddress, prog); err != nil {
+		return false, err
+	}
+	if err := st.SetFlag(ctx, collectionAddress, flagIndexed, true); err != nil {
+		return false, err
+	}
+	st.SetStatus(ctx, processName, "idle")
+	log.Printf("[Backfill] %s: первичный проход завершён: %s", collectionAddress, prog)
+	return false, nil
+}
+
+// pollHead применяет события с головы истории, которых ещё не было, — чтобы новые
+// продажи не ждали окончания первичного прохода. Первый опрос только запоминает
+// голову: более ранние события дойдут с проходом и без уведомлений. Если с прошлого
+// опроса событий больше headPageSize, пропущенные тоже дойдут с проходом.
+func pollHead(ctx context.Context, st Store, collectionAddress string) error {
+	prog, err := st.Backfill(ctx, collectionAddress)
+	if err != nil {
+		return err
+	}
+
+	pageCtx, cancel := context.WithTimeout(getgems.WithPriority(ctx, apiqueue.Indexer), indexerPageTimeout)
+	defer cancel()
+	page, err := gg().CollectionHistory(pageCtx, collectionAddress, getgems.HistoryQuery{Limit: headPageSize})
+	if err != nil {
+		return err
+	}
+
+	notify := prog.HeadTS > 0
+	mintPrice := mintPriceFor(collectionAddress)
+	headTS := prog.HeadTS
+	// страница идёт от новых к старым, применяем по порядку времени
+	for i := len(page.Items) - 1; i >= 0; i-- {
+		item := page.Items[i]
+		if item.Timestamp <= prog.HeadTS {
+			continue
+		}
+		if notify {
+			if _, err := applyHistoryItem(ctx, st, collectionAddress, item, "", mintPrice, true); err != nil {
+				return err
+			}
+		}
+		if item.Timestamp > headTS {
+			headTS = item.Timestamp
+		}
+	}
+	if headTS == prog.HeadTS {
+		return nil
+	}
+
+	prog.HeadTS = headTS
+	return st.SetBackfill(ctx, collectionAddress, prog)
+}
@@ -12,8 +12,10 @@ import (
 	"image/png"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	apiqueue "tg-getgems-bot/api"
@@ -32,54 +34,23 @@ func loadDefaultFont() font.Face {
 	return basicfont.Face7x13
 }
 
-type ApiResponse struct {
-	Success  bool `json:"success"`
-	Response struct {
-		Attributes []Attribute `json:"attributes"`
-	} `json:"response"`
-}
-type ApiResponseGreen struct {
-	Success  bool      `json:"success"`
-	Response AttrGreen `json:"response"`
-}
-
-type AttrGreen struct {
-	FloorPrice          float64 `json:"floorPrice"`
-	FloorPriceNano      string  `json:"floorPriceNano"`
-	ItemsCount          int     `json:"itemsCount"`
-	TotalVolumeSold     string  `json:"totalVolumeSold"`
-	TotalVolumeSoldNano string  `json:"totalVolumeSoldNano"`
-	Holders             int     `json:"holders"`
-}
-
-type Attribute struct {
-	TraitType string       `json:"traitType"`
-	Values    []AttrValues `json:"values"`
-}
-
-type AttrValues struct {
-	Value        string `json:"value"`
-	Count        int    `json:"count"`
-	MinPrice     string `json:"minPrice"`
-	MinPriceNano string `json:"minPriceNano"`
-}
-
 var requestGroup singleflight.Group
 
 // --- Утилиты ---
 
-// fetchJSON делает HTTP GET и парсит JSON в result
-func fetchJSON(url string, result any) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// apiTimeout ограничивает ожидание одного запроса к API вместе со временем в очереди
+const apiTimeout = 30 * time.Second
+
+// fetchJSON делает HTTP GET и парсит JSON в result.
+// Для getgems используется клиент из пакета getgems, здесь — сторонние API.
+func fetchJSON(ctx context.Context, url string, result any, priority apiqueue.RequestPriority) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("accept", "application/json")
-	if token := os.Getenv("GETGEMS_TOKEN"); token != "" {
-		req.Header.Add("Authorization", token)
-	}
 
-	resp, err := apiqueue.Queue.Enqueue(req, apiqueue.Low)
+	resp, err := apiqueue.Queue.EnqueueContext(ctx, req, priority)
 	if err != nil {
 		return nil, err
 	}
@@ -123,46 +94,34 @@ func calcProfit(price, base float64) float64 {
 
 // --- API-функции ---
 
-// GetMinPrice возвращает минимальную цену Reactor из коллекции с кэшированием
-func GetMinPrice(redisClient *redis.Client) (float64, error) {
-	cacheKey := "min_price_reactor"
+// GetMinPrice возвращает минимальную цену флорного трейта основной коллекции с кэшированием
+func GetMinPrice(st Store, p *Product) (float64, error) {
+	cacheKey := p.cacheKey("min_price_trait")
 
 	val, err, _ := requestGroup.Do(cacheKey, func() (interface{}, error) {
-		cached, err := redisClient.Get(Ctx, cacheKey).Result()
-		if err == nil && cached != "" {
-			price, _ := strconv.ParseFloat(cached, 64)
-			log.Printf("[Redis] Возврат из кэша min_price_reactor: %.2f", price)
+		if price, ok, _ := st.CachedPrice(Ctx, cacheKey); ok {
+			log.Printf("[Redis] Возврат из кэша %s: %.2f", cacheKey, price)
 			return price, nil
 		}
 
-		type ApiResponse struct {
-			Response struct {
-				Attributes []struct {
-					Values []struct {
-						Value    string `json:"value"`
-						MinPrice string `json:"minPrice"`
-					} `json:"values"`
-				} `json:"attributes"`
-			} `json:"response"`
-		}
-
-		var data ApiResponse
-		url := "https://api.getgems.io/public-api/v1/collection/attributes/EQC4XEulxb05Le5gF6esMtDWT5XZ6tlzlMBQGNsqffxpdC5U"
-		if _, err := fetchJSON(url, &data); err != nil {
+		ctx, cancel := context.WithTimeout(Ctx, apiTimeout)
+		defer cancel()
+		attributes, err := gg().CollectionAttributes(ctx, p.Collection)
+		if err != nil {
 			return 0.0, err
 		}
 
-		for _, attr := range data.Response.Attributes {
+		for _, attr := range attributes {
 			for _, v := range attr.Values {
-				if v.Value == "Reactor" {
+				if p.FloorTrait.matches(attr.TraitType, v.Value) {
 					price, _ := strconv.ParseFloat(v.MinPrice, 64)
-					redisClient.Set(Ctx, cacheKey, price, time.Hour)
-					log.Printf("[API] min_price_reactor: %.2f", price)
+					st.CachePrice(Ctx, cacheKey, price, time.Hour)
+					log.Printf("[API] %s: %.2f", cacheKey, price)
 					return price, nil
 				}
 			}
 		}
-		return 0.0, errors.New("не найден min_price Reactor")
+		return 0.0, fmt.Errorf("не найден min_price %s", p.FloorTrait.Value)
 	})
 
 	if err != nil {
@@ -171,30 +130,24 @@ func GetMinPrice(redisClient *redis.Client) (float64, error) {
 	return val.(float64), nil
 }
 
-// GetMinPriceGreen возвращает минимальный флор Green с кэшированием
-func GetMinPriceGreen(redisClient *redis.Client) (float64, error) {
-	cacheKey := "min_price_green"
+// GetMinPriceGreen возвращает флор коллекции фрагментов с кэшированием
+func GetMinPriceGreen(st Store, p *Product) (float64, error) {
+	cacheKey := p.cacheKey("min_price_green")
 	val, err, _ := requestGroup.Do(cacheKey, func() (interface{}, error) {
-		cached, _ := redisClient.Get(Ctx, cacheKey).Result()
-		if cached != "" {
-			price, _ := strconv.ParseFloat(cached, 64)
-			log.Printf("[Redis] min_price_green: %.2f", price)
+		if price, ok, _ := st.CachedPrice(Ctx, cacheKey); ok {
+			log.Printf("[Redis] %s: %.2f", cacheKey, price)
 			return price, nil
 		}
 
-		type ApiResp struct {
-			Response struct {
-				FloorPrice float64 `json:"floorPrice"`
-			} `json:"response"`
-		}
-		var data ApiResp
-		url := "https://api.getgems.io/public-api/v1/collection/stats/EQAnmo8tBH8gSErzWDrdlJiF8kxgfJEynKMIBxL2MkuHvPBc"
-		if _, err := fetchJSON(url, &data); err != nil {
+		ctx, cancel := context.WithTimeout(Ctx, apiTimeout)
+		defer cancel()
+		price, err := fetchCollectionFloor(ctx, p.FragmentCollection)
+		if err != nil {
 			return 0.0, err
 		}
-		redisClient.Set(Ctx, cacheKey, data.Response.FloorPrice, 5*time.Hour)
-		log.Printf("[API] min_price_green: %.2f", data.Response.FloorPrice)
-		return data.Response.FloorPrice, nil
+		st.CachePrice(Ctx, cacheKey, price, floorCacheTTL)
+		log.Printf("[API] %s: %.2f", cacheKey, price)
+		return price, nil
 	})
 	if err != nil {
 		return 0, err
@@ -202,30 +155,24 @@ func GetMinPriceGreen(redisClient *redis.Client) (float64, error) {
 	return val.(float64), nil
 }
 
-// GetMinPriceFloor возвращает минимальный флор коллекции с кэшированием
-func GetMinPriceFloor(redisClient *redis.Client) (float64, error) {
-	cacheKey := "min_price_floor"
+// GetMinPriceFloor возвращает минимальный флор основной коллекции с кэшированием
+func GetMinPriceFloor(st Store, p *Product) (float64, error) {
+	cacheKey := p.cacheKey("min_price_floor")
 	val, err, _ := requestGroup.Do(cacheKey, func() (interface{}, error) {
-		cached, _ := redisClient.Get(Ctx, cacheKey).Result()
-		if cached != "" {
-			price, _ := strconv.ParseFloat(cached, 64)
-			log.Printf("[Redis] min_price_floor: %.2f", price)
+		if price, ok, _ := st.CachedPrice(Ctx, cacheKey); ok {
+			log.Printf("[Redis] %s: %.2f", cacheKey, price)
 			return price, nil
 		}
 
-		type ApiResp struct {
-			Response struct {
-				FloorPrice float64 `json:"floorPrice"`
-			} `json:"response"`
-		}
-		var data ApiResp
-		url := "https://api.getgems.io/public-api/v1/collection/stats/EQC4XEulxb05Le5gF6esMtDWT5XZ6tlzlMBQGNsqffxpdC5U"
-		if _, err := fetchJSON(url, &data); err != nil {
+		ctx, cancel := context.WithTimeout(Ctx, apiTimeout)
+		defer cancel()
+		price, err := fetchCollectionFloor(ctx, p.Collection)
+		if err != nil {
 			return 0.0, err
 		}
-		redisClient.Set(Ctx, cacheKey, data.Response.FloorPrice, 5*time.Hour)
-		log.Printf("[API] min_price_floor: %.2f", data.Response.FloorPrice)
-		return data.Response.FloorPrice, nil
+		st.CachePrice(Ctx, cacheKey, price, floorCacheTTL)
+		log.Printf("[API] %s: %.2f", cacheKey, price)
+		return price, nil
 	})
 	if err != nil {
 		return 0, err
@@ -234,31 +181,20 @@ func GetMinPriceFloor(redisClient *redis.Client) (float64, error) {
 }
 
 // GetTonPrice возвращает текущую цену TON в USD
-func GetTonPrice(redisClient *redis.Client) (float64, error) {
+func GetTonPrice(st Store) (float64, error) {
 	cacheKey := "ton_usd"
 	val, err, _ := requestGroup.Do(cacheKey, func() (interface{}, error) {
-	cached, _ := redisClient.Get(Ctx, cacheKey).Result()
-		if cached != "" {
-			price, _ := strconv.ParseFloat(cached, 64)
+		if price, ok, _ := st.CachedPrice(Ctx, cacheKey); ok {
 			return price, nil
 		}
-		type quote struct {
-			Price float64 `json:"price"`
-		}
-		var parsed struct {
-			Quotes map[string]quote `json:"quotes"`
-		}
-		url := "https://api.coinpaprika.com/v1/tickers/ton-toncoin"
-		body, err := fetchJSON(url, &parsed)
+		ctx, cancel := context.WithTimeout(Ctx, apiTimeout)
+		defer cancel()
+		price, err := fetchTonPrice(ctx, apiqueue.Interactive)
 		if err != nil {
 			return 0.0, err
 		}
-		q, ok := parsed.Quotes["USD"]
-		if !ok {
-			return 0.0, fmt.Errorf("USD quote missing: %s", string(body))
-		}
-		redisClient.Set(Ctx, cacheKey, q.Price, 5*time.Minute)
-		return q.Price, nil
+		st.CachePrice(Ctx, cacheKey, price, tonPriceCacheTTL)
+		return price, nil
 	})
 	if err != nil {
 		return 0, err
@@ -266,39 +202,24 @@ func GetTonPrice(redisClient *redis.Client) (float64, error) {
 	return val.(float64), nil
 }
 
-// GetFirstOnSalePrice возвращает цену первой NFT на продаже
-func GetFirstOnSalePrice(redisClient *redis.Client) (float64, error) {
-	cacheKey := "first_price_collection"
+// GetFirstOnSalePrice возвращает цену первой NFT основной коллекции на продаже
+func GetFirstOnSalePrice(st Store, p *Product) (float64, error) {
+	cacheKey := p.cacheKey("first_price_collection")
 	val, err, _ := requestGroup.Do(cacheKey, func() (interface{}, error) {
-		cached, _ := redisClient.Get(Ctx, cacheKey).Result()
-		if cached != "" {
-			price, _ := strconv.ParseFloat(cached, 64)
-			log.Printf("[Redis] first_price_collection: %.2f", price)
+		if price, ok, _ := st.CachedPrice(Ctx, cacheKey); ok {
+			log.Printf("[Redis] %s: %.2f", cacheKey, price)
 			return price, nil
 		}
 
-		type OnSaleResponse struct {
-			Response struct {
-				Items []struct {
-					Sale struct {
-						FullPrice string `json:"fullPrice"`
-					} `json:"sale"`
-				} `json:"items"`
-			} `json:"response"`
-		}
-		var data OnSaleResponse
-		url := "https://api.getgems.io/public-api/v1/nfts/offchain/on-sale/EQC4XEulxb05Le5gF6esMtDWT5XZ6tlzlMBQGNsqffxpdC5U"
-		if _, err := fetchJSON(url, &data); err != nil {
+		ctx, cancel := context.WithTimeout(Ctx, apiTimeout)
+		defer cancel()
+		price, err := fetchFirstOnSalePrice(ctx, p.Collection)
+		if err != nil {
 			return 0.0, err
 		}
-		if len(data.Response.Items) == 0 {
-			return 0.0, errors.New("нет NFT в продаже")
-		}
-		price, _ := strconv.ParseFloat(data.Response.Items[0].Sale.FullPrice, 64)
-		priceFinal := price / 1e9
-		redisClient.Set(Ctx, cacheKey, priceFinal, time.Hour)
-		log.Printf("[API] first_price_collection: %.2f", priceFinal)
-		return priceFinal, nil
+		st.CachePrice(Ctx, cacheKey, price, onSaleCacheTTL)
+		log.Printf("[API] %s: %.2f", cacheKey, price)
+		return price, nil
 	})
 	if err != nil {
 		return 0, err
@@ -306,60 +227,81 @@ func GetFirstOnSalePrice(redisClient *redis.Client) (float64, error) {
 	return val.(float64), nil
 }
 
-// GetCount возвращает количество купленных фрагментов за день/неделю/месяц
-func GetCount(redisClient *redis.Client) (*FragmentCount, error) {
-	now := time.Now().UTC()
-	dayKey := "collection:sales:day:" + now.Format("20060102")
+// Сколько живут в кэше цены из API
+const (
+	floorCacheTTL    = 5 * time.Hour
+	onSaleCacheTTL   = time.Hour
+	tonPriceCacheTTL = 5 * time.Minute
+)
+
+// fetchCollectionFloor — флор коллекции прямо из API, без кэша
+func fetchCollectionFloor(ctx context.Context, collection string) (float64, error) {
+	stats, err := gg().CollectionStats(ctx, collection)
+	if err != nil {
+		return 0, err
+	}
+	return stats.FloorPrice, nil
+}
+
+// fetchFirstOnSalePrice — цена первой NFT коллекции на продаже прямо из API, без кэша
+func fetchFirstOnSalePrice(ctx context.Context, collection string) (float64, error) {
+	page, err := gg().OnSale(ctx, collection, 0, "")
+	if err != nil {
+		return 0, err
+	}
+	if len(page.Items) == 0 || page.Items[0].Sale == nil {
+		return 0, errors.New("нет NFT в продаже")
+	}
+	price, _ := strconv.ParseFloat(page.Items[0].Sale.FullPrice, 64)
+	return price / 1e9, nil
+}
 
-	year, week := now.ISOWeek()
-	weekKey := fmt.Sprintf("collection:sales:week:%d%02d", year, week)
+// fetchTonPrice — цена TON в USD прямо из API, без кэша
+func fetchTonPrice(ctx context.Context, priority apiqueue.RequestPriority) (float64, error) {
+	type quote struct {
+		Price float64 `json:"price"`
+	}
+	var parsed struct {
+		Quotes map[string]quote `json:"quotes"`
+	}
+	url := "https://api.coinpaprika.com/v1/tickers/ton-toncoin"
+	body, err := fetchJSON(ctx, url, &parsed, priority)
+	if err != nil {
+		return 0, err
+	}
+	q, ok := parsed.Quotes["USD"]
+	if !ok {
+		return 0, fmt.Errorf("USD quote missing: %s", string(body))
+	}
+	return q.Price, nil
+}
 
-	monthKey := "collection:sales:month:" + now.Format("200601")
+// GetCount возвращает количество купленных фрагментов коллекции за день/неделю/месяц
+func GetCount(st Store, collection string) (*FragmentCount, error) {
+	now := time.Now().UnixMilli()
 
-	get := func(key string) int {
-		v, err := redisClient.Get(Ctx, key).Int()
+	get := func(period, bucket string) int {
+		v, err := st.SalesCount(Ctx, collection, period, bucket)
 		if err != nil {
 			return 0
 		}
-		return v
+		return int(v)
 	}
 
 	count := &FragmentCount{
-		Day:   get(dayKey),
-		Week:  get(weekKey),
-		Month: get(monthKey),
+		Day:   get("day", dayKey(now)),
+		Week:  get("week", weekKey(now)),
+		Month: get("month", monthKey(now)),
 	}
 
 	log.Printf(
-		"[Redis] fragment_count: день=%d, неделя=%d, месяц=%d",
+		"[Store] fragment_count: день=%d, неделя=%d, месяц=%d",
 		count.Day, count.Week, count.Month,
 	)
 
 	return count, nil
 }
 
-// fetchHistoryCount подсчитывает количество продаж в истории
-func fetchHistoryCount(url string) (int, error) {
-	type HistoryResponse struct {
-		Success  bool `json:"success"`
-		Response struct {
-			Items []struct {
-				EventType string `json:"eventType"`
-			} `json:"items"`
-		} `json:"response"`
-	}
-	var data HistoryResponse
-	body, err := fetchJSON(url, &data)
-	if err != nil {
-		return 0, err
-	}
-	count := len(data.Response.Items)
-	if count == 0 {
-		log.Printf("[API] fetchHistoryCount пусто: %s", string(body))
-	}
-	return count, nil
-}
-
 // GenerateStatImage создает картинку со статистикой цен и покупок
 //
 //go:embed Alkia.ttf
@@ -372,13 +314,14 @@ type FragmentCount struct {
 func GenerateStatImage(
 	price, startProfit, priceG, endProfit, avgPrice, avgProfit float64,
 	count *FragmentCount, TonPrice float64, startProfitUsd float64,
+	stats *PriceStats, trend FloorTrend, stale bool, p *Product,
 ) (string, error) {
 
 	const (
 		width     = 800
-		height    = 700
+		height    = 875
 		margin    = 20
-		numBlocks = 4
+		numBlocks = 5
 		fontSize  = 32
 	)
 	
@@ -500,6 +443,45 @@ func GenerateStatImage(
 		return d.MeasureString(text).Ceil()
 	}
 
+	// --- треугольник вверх/вниз с основанием на строке y ---
+	drawTriangle := func(x, y, size int, up bool, c color.Color) {
+		for row := 0; row < size; row++ {
+			half := row / 2
+			if !up {
+				half = (size - 1 - row) / 2
+			}
+			draw.Draw(
+				img,
+				image.Rect(x+size/2-half, y-size+row, x+size/2+half+1, y-size+row+1),
+				&image.Uniform{c},
+				image.Point{},
+				draw.Src,
+			)
+		}
+	}
+
+	// --- изменение в процентах со стрелкой, по центру cx ---
+	drawTrend := func(cx, y int, label string, change float64, ok bool) {
+		value := "n/a"
+		if ok {
+			value = fmt.Sprintf("%.2f%%", math.Abs(change))
+		}
+		arrow := 0
+		if ok && change != 0 {
+			arrow = fontSize/2 + 8
+		}
+		x := cx - (measure(label)+arrow+measure(value))/2
+		drawText(x, y, label, textColor)
+		x += measure(label)
+		c := color.Color(textColor)
+		if arrow > 0 {
+			c = getProfitColor(change, profitGoodColor, profitBadColor)
+			drawTriangle(x, y-4, fontSize/2, change > 0, c)
+			x += arrow
+		}
+		drawText(x, y, value, c)
+	}
+
 	blockHeight := (height - 2*margin) / numBlocks
 
 	// --- БЛОКИ ---
@@ -508,19 +490,23 @@ func GenerateStatImage(
 		draw  func(yStart int)
 	}{
 		{
-			title: "Heart Locket Floor",
+			title: p.Name + " Floor",
 			draw: func(y int) {
 				val := fmt.Sprintf("%.2f", price)
 				x := width/2 - measure(val)/2
 				drawTextColoredDigits(x, y+blockHeight/2, val, textColor, profitGoodColor, profitBadColor)
+
+				// изменение флора: в шрифте нет стрелок, треугольники рисуем сами
+				drawTrend(width/3, y+blockHeight/2+fontSize*3/2, "24h ", trend.Change24h, trend.Has24h)
+				drawTrend(2*width/3, y+blockHeight/2+fontSize*3/2, "7d ", trend.Change7d, trend.Has7d)
 			},
 		},
 		{
 			title: "Stats (secondary market)",
 			draw: func(y int) {
-				priceusd := 1.4*3.125
+				priceusd := p.MintPriceUSD()
 
-				leftTitle  := fmt.Sprintf("Mint: 1.4      (%.2f$)   ", priceusd)
+				leftTitle  := fmt.Sprintf("Mint: %g      (%.2f$)   ", p.MintPrice, priceusd)
 				leftProfit := fmt.Sprintf("PnL: %.2f%% (%.2f%%)", startProfit, startProfitUsd)
 
 				rightTitle := fmt.Sprintf("Actual: %.2f (%.2f$)", priceG, priceG*TonPrice)
@@ -608,6 +594,48 @@ func GenerateStatImage(
 				)
 			},
 		},
+		{
+			title: "Price distribution",
+			draw: func(y int) {
+				if stats == nil || stats.Count == 0 {
+					line := "No data"
+					drawText(width/2-measure(line)/2, y+blockHeight/2, line, textColor)
+					return
+				}
+
+				// слева — медиана и перцентили, справа — гистограмма
+				line1 := fmt.Sprintf("Median: %.2f", stats.Median)
+				line2 := fmt.Sprintf("p10 %.2f  p25 %.2f", stats.P10, stats.P25)
+				line3 := fmt.Sprintf("p75 %.2f  p90 %.2f", stats.P75, stats.P90)
+				drawText(width/4-measure(line1)/2, y+blockHeight/2, line1, textColor)
+				drawTextSmall(margin*2, y+blockHeight/2+fontSize, line2, textColor)
+				drawTextSmall(margin*2, y+blockHeight/2+fontSize*3/2+4, line3, textColor)
+
+				var maxCount int64
+				for _, b := range stats.Histogram {
+					if b.Count > maxCount {
+						maxCount = b.Count
+					}
+				}
+				if maxCount == 0 {
+					return
+				}
+				left, right := width/2+margin, width-2*margin
+				top, bottom := y+fontSize+12, y+blockHeight-margin
+				barWidth := (right - left) / len(stats.Histogram)
+				for i, b := range stats.Histogram {
+					h := int(float64(bottom-top) * float64(b.Count) / float64(maxCount))
+					x := left + i*barWidth
+					draw.Draw(
+						img,
+						image.Rect(x+2, bottom-h, x+barWidth-2, bottom),
+						&image.Uniform{color.RGBA{120, 120, 200, 255}},
+						image.Point{},
+						draw.Src,
+					)
+				}
+			},
+		},
 	}
 
 	// --- РЕНДЕР ---
@@ -632,8 +660,14 @@ func GenerateStatImage(
 		b.draw(y)
 	}
 
+	// --- пометка об устаревших данных ---
+	if stale {
+		staleText := "stale: API unavailable, cached data"
+		drawTextSmall(margin+10, margin+fontSize*2, staleText, profitBadColor)
+	}
+
 	// --- save ---
-	tmpFile := "/tmp/stat_image.png"
+	tmpFile := "/tmp/stat_image_" + p.ID + ".png"
 	f, err := os.Create(tmpFile)
 	if err != nil {
 		return "", err
@@ -665,18 +699,62 @@ func HandleLook(c telebot.Context) error  {
 }
 
 // HandlePS возвращает текущий статус бота
-func HandlePS(redisClient *redis.Client, c telebot.Context) error {
+func HandlePS(rds *redis.Client, st Store, c telebot.Context) error {
 	status := "✅ Бот работает нормально\n\n"
-	collectingStatus, _ := GetValue(redisClient, "process:collecting")
+	collectingStatus, _ := st.Status(Ctx, "collecting")
 	status += "• статус: " + collectingStatus + "\n"
+	status += indexingStatus(st)
+	status += leadershipStatus(rds)
+	status += queueStatus()
 	c.Send(status, &telebot.SendOptions{ThreadID: c.Message().ThreadID})
 	return c.Send(status, &telebot.SendOptions{ThreadID: c.Message().ThreadID})
 	
 }
 
-// getProcessStatus возвращает статус процесса из Redis
-func getProcessStatus(redisClient *redis.Client, processName string) string {
-	status, err := GetValue(redisClient, "process:"+processName)
+// indexingStatus описывает индексацию коллекций и прогресс первичного прохода
+func indexingStatus(st Store) string {
+	var b strings.Builder
+	b.WriteString("\n📚 Индексация\n")
+	for _, p := range Products() {
+		collection := p.FragmentCollection
+		fmt.Fprintf(&b, "• %s: %s\n", p.ID, getProcessStatus(st, "collection_indexing:"+collection))
+		if indexed, _ := st.Flag(Ctx, collection, flagIndexed); indexed {
+			continue
+		}
+		if prog, err := st.Backfill(Ctx, collection); err == nil {
+			fmt.Fprintf(&b, "  первичный проход: %s\n", prog)
+		}
+	}
+	return b.String()
+}
+
+// queueStatus описывает очередь API: глубину и ожидание по классам приоритета
+func queueStatus() string {
+	if apiqueue.Queue == nil {
+		return ""
+	}
+	stats := apiqueue.Queue.Stats()
+	hosts := make([]string, 0, len(stats))
+	for host := range stats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var b strings.Builder
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "\n📡 %s (%s)\n", host, apiqueue.Queue.BreakerState(host))
+		for _, st := range stats[host] {
+			fmt.Fprintf(&b, "• %s: в очереди %d, выполнено %d, ожидание ср. %s / макс. %s, поднято %d\n",
+				st.Priority, st.Depth, st.Dequeued,
+				st.AvgWait.Round(time.Millisecond), st.MaxWait.Round(time.Millisecond), st.Promoted)
+		}
+	}
+	return b.String()
+}
+
+// getProcessStatus возвращает статус процесса из хранилища
+func getProcessStatus(st Store, processName string) string {
+	status, err := st.Status(Ctx, processName)
 	if err != nil || status == "" {
 		return "⏳ В ожидании"
 	}
@@ -711,20 +789,32 @@ func parseTreadID(s string) int {
 	return id
 }
 
-func NotifyNewSales(bot *telebot.Bot, redisClient *redis.Client, collection string) {
+// InstanceName — имя экземпляра бота: потребитель продаж и держатель блокировок
+func InstanceName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func NotifyNewSales(bot *telebot.Bot, st Store, collection string) {
 	ctx := context.Background()
+	consumer := InstanceName()
 	for {
-		// Проверяем очередь новых продаж
-		saleJSON, err := redisClient.LPop(ctx, "collection:new_sales").Result()
+		// Ждём новую продажу или ту, которую не доставил другой экземпляр
+		msg, err := st.ReadSale(ctx, collection, consumer)
 		if err != nil {
-			if errors.Is(err, redis.Nil) {
-				time.Sleep(10 * time.Second) // очередь пустая
-				continue
-			}
-			log.Printf("[Notifier] Redis error: %v", err)
+			log.Printf("[Notifier] store error: %v", err)
 			time.Sleep(10 * time.Second)
 			continue
 		}
+		if msg == nil {
+			continue // очередь пустая
+		}
+		// ack — продажа обработана и больше не будет выдана
+		ack := func() {
+			if err := st.AckSale(ctx, collection, msg.ID); err != nil {
+				log.Printf("[Notifier] ошибка подтверждения %s: %v", msg.ID, err)
+			}
+		}
 
 		var sale struct {
 			Address   string  `json:"address"`
@@ -734,8 +824,9 @@ func NotifyNewSales(bot *telebot.Bot, redisClient *redis.Client, collection stri
 			Timestamp int64   `json:"timestamp"`
 		}
 
-		if err := json.Unmarshal([]byte(saleJSON), &sale); err != nil {
+		if err := json.Unmarshal(msg.Data, &sale); err != nil {
 			log.Printf("[Notifier] Ошибка парсинга saleJSON: %v", err)
+			ack()
 			continue
 		}
 		saleTime := time.UnixMilli(sale.Timestamp)
@@ -749,26 +840,31 @@ func NotifyNewSales(bot *telebot.Bot, redisClient *redis.Client, collection stri
 		// Проверяем, что продажа была сегодня
 		if saleTime.Before(today) || saleTime.After(tomorrow) {
 			log.Printf("[Notifier] Пропущена старая продажа от %v", saleTime.Format("2006-01-02"))
+			ack()
 			continue // Пропускаем, если не сегодня
 		}
 		// --- Отправляем уведомление ---
 		adminID := os.Getenv("CHAT_ID")
 		threadID:= os.Getenv("DEALS_THREAD")
 		if adminID == "" {
+			ack()
 			continue
 		}
 		chat := &telebot.Chat{ID: parseChatID(adminID)}
 		Thread:= parseTreadID(threadID)
 
-		avg, count, err := GetOwnerAvgBuyPrice(redisClient, sale.NewOwner)
+		ownerCtx, cancel := context.WithTimeout(ctx, ownerLookupTimeout)
+		avg, count, err := GetOwnerAvgBuyPrice(ownerCtx, st, collection, sale.NewOwner, apiqueue.Notifier)
+		cancel()
 		ownerLink := fmt.Sprintf(
 			"[ %s ](https://getgems.io/user/%s)",
 			sale.NewOwner,
 			sale.NewOwner,
 		)
 		nftlink := fmt.Sprintf(
-			"[ %s ](https://getgems.io/collection/EQAnmo8tBH8gSErzWDrdlJiF8kxgfJEynKMIBxL2MkuHvPBc/%s)",
+			"[ %s ](https://getgems.io/collection/%s/%s)",
 			sale.Name,
+			collection,
 			sale.Address,
 		)
 
@@ -785,9 +881,15 @@ func NotifyNewSales(bot *telebot.Bot, redisClient *redis.Client, collection stri
 			ThreadID: Thread,
 			ParseMode: telebot.ModeMarkdown,
 			DisableWebPagePreview: true, }); err != nil {
-			log.Printf("[Notifier] Ошибка отправки уведомления: %v", err)
+			// без подтверждения продажа вернётся в очередь через saleClaimIdle
+			log.Printf("[Notifier] Ошибка отправки уведомления (попытка %d): %v", msg.Deliveries, err)
+			if msg.Deliveries >= saleMaxDeliveries {
+				log.Printf("[Notifier] Продажа NFT %s отброшена после %d попыток", sale.Address, msg.Deliveries)
+				ack()
+			}
 		} else {
 			log.Printf("[Notifier] Отправлено уведомление о покупке NFT %s", sale.Address)
+			ack()
 		}
 	}
 }
@@ -0,0 +1,125 @@
+package botutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/getgems"
+)
+
+const (
+	// DefaultFloorSampleInterval — как часто по умолчанию сохраняется снимок флора
+	DefaultFloorSampleInterval = 15 * time.Minute
+	// floorSampleRetention — сколько хранятся снимки флора
+	floorSampleRetention = 30 * 24 * time.Hour
+	// floorSampleTolerance — насколько снимок может быть старше момента сравнения:
+	// более старый значит, что сэмплер тогда не работал, и изменение не считается
+	floorSampleTolerance = 3 * time.Hour
+)
+
+// FloorSample — снимок флора продукта
+type FloorSample struct {
+	TS       int64   `json:"ts"`       // мс
+	Offchain float64 `json:"offchain"` // первая цена на продаже
+	Onchain  float64 `json:"onchain"`  // флор коллекции
+	Fragment float64 `json:"fragment"` // флор коллекции кусочков, как в /floor
+	TonUSD   float64 `json:"ton_usd"`
+}
+
+// Floor — флор NFT, как его показывает /floor
+func (s *FloorSample) Floor() float64 {
+	return math.Min(s.Offchain, s.Onchain)
+}
+
+// SampleFloor снимает текущий флор продукта прямо из API, минуя кэш: цены в нём
+// живут дольше интервала снимков. Запросы идут фоновым классом, чтобы не мешать
+// ответам на команды. Устаревшие значения не подставляются: если API недоступно,
+// снимок не делается. Свежие цены заодно обновляют кэш.
+func SampleFloor(st Store, p *Product, at time.Time) (*FloorSample, error) {
+	ctx, cancel := context.WithTimeout(getgems.WithPriority(Ctx, apiqueue.Backfill), apiTimeout)
+	defer cancel()
+
+	s := &FloorSample{TS: at.UnixMilli()}
+	var err error
+	if s.Offchain, err = fetchFirstOnSalePrice(ctx, p.Collection); err != nil {
+		return nil, err
+	}
+	if s.Onchain, err = fetchCollectionFloor(ctx, p.Collection); err != nil {
+		return nil, err
+	}
+	if s.Fragment, err = fetchCollectionFloor(ctx, p.FragmentCollection); err != nil {
+		return nil, err
+	}
+	if s.TonUSD, err = fetchTonPrice(ctx, apiqueue.Backfill); err != nil {
+		return nil, err
+	}
+
+	st.CachePrice(Ctx, p.cacheKey("first_price_collection"), s.Offchain, onSaleCacheTTL)
+	st.CachePrice(Ctx, p.cacheKey("min_price_floor"), s.Onchain, floorCacheTTL)
+	st.CachePrice(Ctx, p.cacheKey("min_price_green"), s.Fragment, floorCacheTTL)
+	st.CachePrice(Ctx, "ton_usd", s.TonUSD, tonPriceCacheTTL)
+	return s, nil
+}
+
+// SampleFloorPeriodically сохраняет снимок флора продукта раз в interval.
+// Время снимка округляется до interval, так что реплики перезаписывают один снимок, а не копят дубли.
+func SampleFloorPeriodically(st Store, p *Product, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sample, err := SampleFloor(st, p, time.Now().Truncate(interval))
+		if err != nil {
+			log.Printf("[FloorHistory] %s: снимок пропущен: %v", p.ID, err)
+		} else if err := st.AddFloorSample(Ctx, p.ID, *sample); err != nil {
+			log.Printf("[FloorHistory] %s: %v", p.ID, err)
+		}
+		<-ticker.C
+	}
+}
+
+// FloorTrend — изменение флора за 24 часа и 7 дней, в процентах
+type FloorTrend struct {
+	Change24h, Change7d float64
+	Has24h, Has7d       bool // есть ли снимок для сравнения
+}
+
+// GetFloorTrend сравнивает текущий флор со снимками суточной и недельной давности
+func GetFloorTrend(st Store, p *Product, floor float64, now time.Time) FloorTrend {
+	var t FloorTrend
+	t.Change24h, t.Has24h = floorChange(st, p, floor, now.Add(-24*time.Hour))
+	t.Change7d, t.Has7d = floorChange(st, p, floor, now.Add(-7*24*time.Hour))
+	return t
+}
+
+func floorChange(st Store, p *Product, floor float64, at time.Time) (float64, bool) {
+	s, err := st.FloorSampleAt(Ctx, p.ID, at.UnixMilli())
+	if err != nil {
+		log.Printf("[FloorHistory] %s: %v", p.ID, err)
+		return 0, false
+	}
+	if s == nil || at.UnixMilli()-s.TS > floorSampleTolerance.Milliseconds() || s.Floor() <= 0 {
+		return 0, false
+	}
+	return (floor - s.Floor()) / s.Floor() * 100, true
+}
+
+// String — изменения для текстовой сводки: «24ч: ▲ 3.20% · 7д: ▼ 1.10%»
+func (t FloorTrend) String() string {
+	return "24ч: " + trendText(t.Change24h, t.Has24h) + " · 7д: " + trendText(t.Change7d, t.Has7d)
+}
+
+func trendText(change float64, ok bool) string {
+	switch {
+	case !ok:
+		return "—"
+	case change > 0:
+		return fmt.Sprintf("▲ %.2f%%", change)
+	case change < 0:
+		return fmt.Sprintf("▼ %.2f%%", -change)
+	}
+	return "0.00%"
+}
@@ -0,0 +1,23 @@
+package botutils
+
+import (
+	"os"
+	"sync"
+
+	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/getgems"
+)
+
+var (
+	getgemsOnce   sync.Once
+	getgemsClient *getgems.Client
+)
+
+// gg возвращает клиент getgems. Создаётся при первом обращении,
+// когда .env уже загружен и очередь API инициализирована.
+func gg() *getgems.Client {
+	getgemsOnce.Do(func() {
+		getgemsClient = getgems.NewClient(apiqueue.Queue, os.Getenv("GETGEMS_TOKEN"))
+	})
+	return getgemsClient
+}
@@ -1,37 +1,47 @@
 package botutils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/getgems"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"gopkg.in/telebot.v3"
 )
 
-func FloorCheck(redisClient *redis.Client) (string, string) {
-    collectionAddress := os.Getenv("COLLECTION_ADDRESS")
-    if collectionAddress == "" {
-        return "⚠️ COLLECTION_ADDRESS не задан", ""
-    }
+// staleNotice добавляется к сводке, собранной из последних сохранённых цен
+const staleNotice = "⚠️ API недоступно, показаны последние сохранённые данные\n----------------\n"
+
+// FloorCheck собирает сводку по продукту: текст и путь к картинке
+func FloorCheck(st Store, p *Product) (string, string) {
+    collectionAddress := p.FragmentCollection
 
     // --- Ждем завершения первичной индексации с таймаутом 10 минут ---
     timeout := time.After(10 * time.Minute)
     tick := time.Tick(30 * time.Second)
 
     for {
-        indexed, err := redisClient.Get(Ctx, "collection:"+collectionAddress+":indexed").Result()
-        if err != nil && !errors.Is(err, redis.Nil) {
-            log.Printf("[Floor] Redis error при проверке индексации: %v", err)
-            return "Ошибка Redis", ""
+        indexed, err := st.Flag(Ctx, collectionAddress, flagIndexed)
+        if err != nil {
+            log.Printf("[Floor] store error при проверке индексации: %v", err)
+            return "Ошибка хранилища", ""
         }
-        if indexed == "true" {
+        if indexed {
             break // индексация завершена
         }
 
+        // getgems лежит — индексация всё равно не продвинется, отвечаем из кэша
+        if apiqueue.Queue != nil && apiqueue.Queue.BreakerState(getgems.Host) == apiqueue.BreakerOpen {
+            log.Println("[Floor] getgems недоступен, не ждём индексацию")
+            break
+        }
+
         log.Println("[Floor] Первичная индексация ещё не завершена, ждём 30 секунд...")
 
         select {
@@ -44,35 +54,76 @@ func FloorCheck(redisClient *redis.Client) (string, string) {
     }
 
     // --- Получение актуальных цен ---
-    priceOfchain, _ := GetFirstOnSalePrice(redisClient)
-    priceOnchain, _:= GetMinPriceFloor(redisClient)
+    // если API недоступно (breaker открыт или запрос упал), берём последние
+    // сохранённые значения и помечаем сводку как устаревшую
+    stale := false
+    orLast := func(cacheKey string, v float64, err error) float64 {
+        if err == nil {
+            return v
+        }
+        log.Printf("[Floor] %s: %v", cacheKey, err)
+        if last, ok, _ := st.LastPrice(Ctx, cacheKey); ok {
+            stale = true
+            return last
+        }
+        return v
+    }
+
+    priceOfchain, err := GetFirstOnSalePrice(st, p)
+    priceOfchain = orLast(p.cacheKey("first_price_collection"), priceOfchain, err)
+    priceOnchain, err := GetMinPriceFloor(st, p)
+    priceOnchain = orLast(p.cacheKey("min_price_floor"), priceOnchain, err)
     price := Min(priceOfchain, priceOnchain)
 
-    priceGreen, _ := GetMinPriceGreen(redisClient)
-    priceUSD, _ := GetTonPrice(redisClient)
+    priceGreen, err := GetMinPriceGreen(st, p)
+    priceGreen = orLast(p.cacheKey("min_price_green"), priceGreen, err)
+    priceUSD, err := GetTonPrice(st)
+    priceUSD = orLast("ton_usd", priceUSD, err)
 
     // Расчёт прибыли
-    startProfit := (price/1000 - 1.4) / 1.4 * 100
-    startProfitUSD := (price/1000*priceUSD - 1.4*3.125) / (1.4 * 3.125) * 100
-    endProfit := (price/1000 - priceGreen) / priceGreen * 100
+    fragmentFloor := p.FragmentFloor(price)
+    startProfit := calcProfit(fragmentFloor, p.MintPrice)
+    startProfitUSD := calcProfit(fragmentFloor*priceUSD, p.MintPriceUSD())
+    endProfit := calcProfit(fragmentFloor, priceGreen)
 
     // Средняя цена
-    avgPrice, _ := GetAveragePrice(redisClient, collectionAddress)
-    avgProfit := (price/1000 - avgPrice) / avgPrice * 100
+    avgPrice, _ := GetAveragePrice(st, collectionAddress)
+    avgProfit := calcProfit(fragmentFloor, avgPrice)
 
     // Статистика по покупкам
-    count, _ := GetCount(redisClient)
+    count, _ := GetCount(st, collectionAddress)
 
     // --- Формируем текстовое сообщение ---
     msg := fmt.Sprintf(
-        "Флор на Heart Locket: %.2f\n----------------\nминт: 1.4\nпрофит: %.2f%%\n----------------\nфлор кусочков: %.2f\nпрофит: %.2f%%\n----------------\nСредняя цена всех NFT: %.2f\nпрофит сообщества: %.2f%%\n----------------\n📊 Статистика покупок фрагментов:\nЗа день: %d\nЗа неделю: %d\nЗа месяц: %d\n",
-        price, startProfit, priceGreen, endProfit, avgPrice, avgProfit,
-        count.Day, count.Week, count.Month,
+        "Флор на %s: %.2f\n----------------\nминт: %g\nпрофит: %.2f%%\n----------------\nфлор кусочков: %.2f\nпрофит: %.2f%%\n----------------\nСредняя цена всех NFT: %.2f\nпрофит сообщества: %.2f%%\n----------------\n📊 Статистика покупок (%s):\nЗа день: %d\nЗа неделю: %d\nЗа месяц: %d\n",
+        p.Name, price, p.MintPrice, startProfit, priceGreen, endProfit, avgPrice, avgProfit,
+        p.FragmentName, count.Day, count.Week, count.Month,
     )
 
+    // Распределение цен всех NFT
+    stats, err := GetPriceStats(st, collectionAddress)
+    if err != nil {
+        log.Printf("[Floor] статистика цен: %v", err)
+        stats = nil
+    }
+    if stats != nil && stats.Count > 0 {
+        msg += fmt.Sprintf(
+            "----------------\nМедиана цены NFT: %.2f\np10: %.2f · p25: %.2f · p75: %.2f · p90: %.2f\n%s",
+            stats.Median, stats.P10, stats.P25, stats.P75, stats.P90, stats,
+        )
+    }
+
+    // Изменение флора по сохранённым снимкам
+    trend := GetFloorTrend(st, p, price, time.Now())
+    msg += "----------------\nИзменение флора: " + trend.String() + "\n"
+
+    if stale {
+        msg = staleNotice + msg
+    }
+
     // --- Генерация картинки ---
     imgPath := ""
-    imgPath, err := GenerateStatImage(price, startProfit, priceGreen, endProfit, avgPrice, avgProfit, count, priceUSD, startProfitUSD)
+    imgPath, err = GenerateStatImage(price, startProfit, priceGreen, endProfit, avgPrice, avgProfit, count, priceUSD, startProfitUSD, stats, trend, stale, p)
     if err != nil {
         log.Printf("[Floor] Ошибка генерации изображения: %v", err)
         imgPath = "" // Если не удалось, вернем пустую строку
@@ -82,30 +133,41 @@ func FloorCheck(redisClient *redis.Client) (string, string) {
 }
 
 
-func HandleFloor(bot *telebot.Bot, redisClient *redis.Client, c telebot.Context) error {
+// HandleFloor отвечает на /floor [продукт]; без аргумента — продукт по умолчанию
+func HandleFloor(bot *telebot.Bot, st Store, c telebot.Context) error {
     chat := c.Chat()
-    // Проверяем, завершена ли первичная индексация
-    collectionAddress := os.Getenv("COLLECTION_ADDRESS")
-    if collectionAddress == "" {
-        bot.Send(chat, "⚠️ COLLECTION_ADDRESS не задан", &telebot.SendOptions{ReplyTo: c.Message()})
+    selector := ""
+    if args := strings.Fields(c.Text()); len(args) > 1 {
+        selector = args[1]
+    }
+    p, ok := ProductBySelector(selector)
+    if !ok {
+        bot.Send(chat, "❌ Неизвестная коллекция. Доступны: "+productIDs(), &telebot.SendOptions{ReplyTo: c.Message()})
         return nil
     }
+    // Проверяем, завершена ли первичная индексация
+    collectionAddress := p.FragmentCollection
 
-    indexed, err := redisClient.Get(Ctx, "collection:"+collectionAddress+":indexed").Result()
-    if err != nil && !errors.Is(err, redis.Nil) {
-        log.Printf("[Floor] Redis error: %v", err)
-        bot.Send(chat, "Ошибка Redis при проверке индексации", &telebot.SendOptions{ReplyTo: c.Message()})
+    indexed, err := st.Flag(Ctx, collectionAddress, flagIndexed)
+    if err != nil {
+        log.Printf("[Floor] store error: %v", err)
+        bot.Send(chat, "Ошибка хранилища при проверке индексации", &telebot.SendOptions{ReplyTo: c.Message()})
         return nil
     }
 
     var waitMsg *telebot.Message
-    if indexed != "true" {
+    getgemsDown := apiqueue.Queue != nil && apiqueue.Queue.BreakerState(getgems.Host) == apiqueue.BreakerOpen
+    if !indexed && !getgemsDown {
         // Отправляем сообщение о том, что нужно подождать
-        waitMsg, _ = bot.Send(chat, "⌛ Первичная индексация ещё не завершена, подождите...", &telebot.SendOptions{ReplyTo: c.Message()})
+        text := "⌛ Первичная индексация ещё не завершена, подождите..."
+        if prog, err := st.Backfill(Ctx, collectionAddress); err == nil && prog.Pages > 0 {
+            text = "⌛ Первичная индексация ещё не завершена (" + prog.String() + "), подождите..."
+        }
+        waitMsg, _ = bot.Send(chat, text, &telebot.SendOptions{ReplyTo: c.Message()})
     }
 
     // Запускаем FloorCheck (ожидает завершения индексации)
-    msgText, imgPath := FloorCheck(redisClient)
+    msgText, imgPath := FloorCheck(st, p)
 
     // Удаляем сообщение о ожидании, если оно было
     if waitMsg != nil {
@@ -127,11 +189,22 @@ func HandleFloor(bot *telebot.Bot, redisClient *redis.Client, c telebot.Context)
     return nil
 }
 // --- HandleMeSingleLine обрабатывает команду /me с адресом сразу ---
-func HandleMeSingleLine(redisClient *redis.Client) func(c telebot.Context) error {
+// Формат: /address <TON-address> [продукт]
+func HandleMeSingleLine(st Store) func(c telebot.Context) error {
 	return func(c telebot.Context) error {
 		args := strings.Fields(c.Text()) // разделяем команду и аргументы
-		if len(args) != 2 {
-			c.Reply("❌ Пожалуйста, укажите TON-адрес: /address <TON-address>")
+		if len(args) != 2 && len(args) != 3 {
+			c.Reply("❌ Пожалуйста, укажите TON-адрес: /address <TON-address> [коллекция]")
+			return nil
+		}
+
+		selector := ""
+		if len(args) == 3 {
+			selector = args[2]
+		}
+		p, ok := ProductBySelector(selector)
+		if !ok {
+			c.Reply("❌ Неизвестная коллекция. Доступны: " + productIDs())
 			return nil
 		}
 
@@ -142,9 +215,16 @@ func HandleMeSingleLine(redisClient *redis.Client) func(c telebot.Context) error
 		}
 
 		// Получаем данные
-		avgPrice, count, err := GetOwnerAvgBuyPrice(redisClient, ownerAddress)
+		ctx, cancel := context.WithTimeout(Ctx, ownerLookupTimeout)
+		defer cancel()
+		avgPrice, count, err := GetOwnerAvgBuyPrice(ctx, st, p.FragmentCollection, ownerAddress, apiqueue.Interactive)
 		if err != nil {
 			log.Println("❌ /address error:", err)
+			var canceled *apiqueue.CanceledError
+			if errors.As(err, &canceled) {
+				c.Reply("⌛ API getgems не ответило вовремя, попробуйте позже")
+				return nil
+			}
 			c.Reply("Ошибка при получении данных")
 			return nil
 		}
@@ -154,8 +234,8 @@ func HandleMeSingleLine(redisClient *redis.Client) func(c telebot.Context) error
 			return nil
 		}
 
-		priceOfchain, _ := GetFirstOnSalePrice(redisClient)
-        priceOnchain, _:= GetMinPriceFloor(redisClient)
+		priceOfchain, _ := GetFirstOnSalePrice(st, p)
+        priceOnchain, _:= GetMinPriceFloor(st, p)
         price := Min(priceOfchain, priceOnchain)
 
 		if err != nil {
@@ -163,10 +243,10 @@ func HandleMeSingleLine(redisClient *redis.Client) func(c telebot.Context) error
 			return nil
 		}
 
-		pnl := (price/1000 - avgPrice) / avgPrice * 100
+		pnl := calcProfit(p.FragmentFloor(price), avgPrice)
 		text := fmt.Sprintf(
-			"Фрагментов: %d\nСредняя цена покупки: %.2f TON\nfloor Heart Locket: %.2f TON\nPNL: %.2f%%",
-			count, avgPrice, price, pnl,
+			"Фрагментов: %d\nСредняя цена покупки: %.2f TON\nfloor %s: %.2f TON\nPNL: %.2f%%",
+			count, avgPrice, p.Name, price, pnl,
 		)
 		c.Reply(text)
 		return nil
@@ -183,8 +263,8 @@ func Min(priceOfchain, priceOnchain float64) float64 {
 }
 
 // HandleCount processes /count command
-func HandleCount(redisClient *redis.Client, c telebot.Context) error {
-	count, err := GetCount(redisClient)
+func HandleCount(st Store, c telebot.Context) error {
+	count, err := GetCount(st, DefaultProduct().FragmentCollection)
 	if err != nil {
 		log.Printf("Ошибка получения статистики: %v", err)
 		return c.Send("❌ Ошибка получения статистики покупок")
@@ -202,9 +282,63 @@ func HandleCount(redisClient *redis.Client, c telebot.Context) error {
 		count.Month,
 	)
 
+	// держатели известны только из проиндексированной истории
+	collection := DefaultProduct().FragmentCollection
+	if indexed, _ := st.Flag(Ctx, collection, flagIndexed); indexed {
+		if holders, err := st.HolderCount(Ctx, collection); err == nil {
+			msg += fmt.Sprintf("Держателей: %d\n", holders)
+		}
+	}
+
 	return c.Send(msg)
 }
 
+// isAdmin — пользователь из ADMIN_IDS (id через запятую)
+func isAdmin(userID int64) bool {
+	for _, id := range strings.Split(os.Getenv("ADMIN_IDS"), ",") {
+		if strings.TrimSpace(id) != "" && parseChatID(strings.TrimSpace(id)) == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleWipe удаляет индекс коллекции: /wipe <продукт|all> yes. Только для администраторов.
+func HandleWipe(redisClient *redis.Client) func(c telebot.Context) error {
+	return func(c telebot.Context) error {
+		if c.Sender() == nil || !isAdmin(c.Sender().ID) {
+			return c.Reply("⛔ Команда доступна только администраторам")
+		}
+
+		args := strings.Fields(c.Text())
+		if len(args) != 3 || args[2] != "yes" {
+			return c.Reply("⚠️ Индекс будет удалён и собран заново. Подтвердите: /wipe <коллекция|all> yes\nДоступны: " + productIDs())
+		}
+
+		var targets []*Product
+		if args[1] == "all" {
+			targets = Products()
+		} else {
+			p, ok := ProductBySelector(args[1])
+			if !ok {
+				return c.Reply("❌ Неизвестная коллекция. Доступны: " + productIDs())
+			}
+			targets = []*Product{p}
+		}
+
+		ctx, cancel := context.WithTimeout(Ctx, indexLockTTL)
+		defer cancel()
+		for _, p := range targets {
+			if err := WipeCollection(ctx, redisClient, p.FragmentCollection); err != nil {
+				log.Printf("[Wipe] %s: %v", p.ID, err)
+				return c.Reply("❌ Не удалось удалить индекс " + p.ID + ": " + err.Error())
+			}
+			log.Printf("[Wipe] %s: индекс удалён по команде %d", p.ID, c.Sender().ID)
+		}
+		return c.Reply("🗑 Индекс удалён, индексатор соберёт его заново")
+	}
+}
+
 var waitingForAddress = make(map[int64]bool)
 
 func HandleMe(redisClient *redis.Client) func(c telebot.Context) error {
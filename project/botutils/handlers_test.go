@@ -0,0 +1,103 @@
+package botutils
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/telebot.v3"
+)
+
+// sendContext — контекст telebot, который только запоминает отправленное
+type sendContext struct {
+	telebot.Context
+	sent []interface{}
+}
+
+func (c *sendContext) Send(what interface{}, opts ...interface{}) error {
+	c.sent = append(c.sent, what)
+	return nil
+}
+
+// recentSales применяет к st продажи с интервалом в миллисекунду, последняя — ts
+func recentSales(t *testing.T, st Store, ts int64, prices ...float64) {
+	t.Helper()
+	for i, price := range prices {
+		at := ts - int64(len(prices)-1-i)
+		applyItems(t, st, soldItem(testNft1, at, "o1", "o2", price))
+	}
+}
+
+func TestHandleCount(t *testing.T) {
+	st := NewMemoryStore()
+	c := testCollection()
+	recentSales(t, st, time.Now().UnixMilli(), 2, 3)
+
+	ctx := &sendContext{}
+	if err := HandleCount(st, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.sent) != 1 {
+		t.Fatalf("отправлено %d сообщений, ожидалось одно", len(ctx.sent))
+	}
+	msg, _ := ctx.sent[0].(string)
+	if !strings.Contains(msg, "За день: 2\n") || !strings.Contains(msg, "За месяц: 2\n") {
+		t.Errorf("неверная статистика:\n%s", msg)
+	}
+	// до конца первичной индексации число держателей не показываем
+	if strings.Contains(msg, "Держателей") {
+		t.Errorf("держатели показаны до индексации:\n%s", msg)
+	}
+
+	st.SetFlag(Ctx, c, flagIndexed, true)
+	ctx.sent = nil
+	if err := HandleCount(st, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := ctx.sent[0].(string); !strings.Contains(msg, "Держателей: 1\n") {
+		t.Errorf("нет числа держателей:\n%s", msg)
+	}
+}
+
+func TestFloorCheck(t *testing.T) {
+	st := NewMemoryStore()
+	p := DefaultProduct()
+	c := p.FragmentCollection
+
+	applyItems(t, st,
+		mintItem(testNft1, 1000, "o1"),
+		mintItem(testNft2, 1100, "o2"),
+	)
+	recentSales(t, st, time.Now().UnixMilli(), 2.6)
+	st.SetFlag(Ctx, c, flagIndexed, true)
+
+	// цены API уже в кэше: запросов к getgems и курсу TON не будет
+	st.CachePrice(Ctx, p.cacheKey("first_price_collection"), 1500, time.Hour)
+	st.CachePrice(Ctx, p.cacheKey("min_price_floor"), 1200, time.Hour)
+	st.CachePrice(Ctx, p.cacheKey("min_price_green"), 1.1, time.Hour)
+	st.CachePrice(Ctx, "ton_usd", 4, time.Hour)
+
+	msg, img := FloorCheck(st, p)
+	if img != "" {
+		defer os.Remove(img)
+	}
+
+	for _, want := range []string{
+		"Флор на Heart Locket: 1200.00\n",
+		"флор кусочков: 1.10\n",
+		"Средняя цена всех NFT: 2.00\n",
+		"За день: 1\n",
+		"Медиана цены NFT: 2.00\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("в сводке нет %q:\n%s", want, msg)
+		}
+	}
+	if strings.HasPrefix(msg, staleNotice) {
+		t.Errorf("сводка из кэша помечена устаревшей:\n%s", msg)
+	}
+	if img == "" {
+		t.Error("картинка не сгенерирована")
+	}
+}
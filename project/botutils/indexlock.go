@@ -0,0 +1,258 @@
+package botutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// indexLockTTL — на сколько берётся и продлевается блокировка индексатора коллекции
+	indexLockTTL = 5 * time.Minute
+	// indexLockRenew — как часто держатель продлевает блокировку
+	indexLockRenew = indexLockTTL / 3
+	// indexLockPoll — как часто ожидающий пробует взять блокировку
+	indexLockPoll = 5 * time.Second
+	// IndexLockHandoff — пауза держателя между порциями работы: дольше интервала
+	// опроса, чтобы ожидающий (rebuild, check -repair, /wipe) успел взять блокировку
+	IndexLockHandoff = indexLockPoll + time.Second
+)
+
+// ErrLockLost — блокировку индексатора перехватил другой держатель:
+// запись с устаревшим токеном отклонена
+var ErrLockLost = errors.New("блокировка индексатора потеряна")
+
+// IndexLockKey — блокировка, под которой индексируется коллекция
+func IndexLockKey(collection string) string {
+	return "lock:collection_index:" + collection
+}
+
+// indexFenceKey — счётчик токенов ограждения блокировки коллекции
+func indexFenceKey(collection string) string {
+	return fenceKeyOf(IndexLockKey(collection))
+}
+
+// fenceKeyOf — счётчик токенов ограждения блокировки key
+func fenceKeyOf(key string) string {
+	return key + ":fence"
+}
+
+// acquireLockScript берёт блокировку и выдаёт следующий токен ограждения.
+// KEYS: 1 — блокировка, 2 — счётчик токенов; ARGV: 1 — держатель, 2 — TTL, мс.
+// Возвращает токен или 0, если блокировка занята.
+var acquireLockScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ' ' .. token, 'PX', ARGV[2])
+return token
+`)
+
+// renewLockScript продлевает блокировку, только если её держим мы.
+// KEYS: 1 — блокировка; ARGV: 1 — значение блокировки, 2 — TTL, мс.
+var renewLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLockScript удаляет блокировку, только если её держим мы
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// IndexLock — захваченная блокировка индексатора коллекции (или другой работы,
+// которую должна делать одна реплика, например миграции). Пока она не отпущена,
+// фоновая горутина продлевает её; если продлить не удалось, Context отменяется.
+// Token растёт с каждым захватом: записи с меньшим токеном отклоняются.
+type IndexLock struct {
+	rds    *redis.Client
+	key    string
+	Holder string
+	Token  int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// TryIndexLock берёт блокировку коллекции, если она свободна; nil — занята
+func TryIndexLock(ctx context.Context, rds *redis.Client, collection, holder string) (*IndexLock, error) {
+	return tryLock(ctx, rds, IndexLockKey(collection), holder)
+}
+
+// AcquireIndexLock ждёт, пока блокировка коллекции освободится, и берёт её
+func AcquireIndexLock(ctx context.Context, rds *redis.Client, collection, holder string) (*IndexLock, error) {
+	return acquireLock(ctx, rds, IndexLockKey(collection), holder)
+}
+
+// tryLock берёт блокировку key, если она свободна; nil — занята
+func tryLock(ctx context.Context, rds *redis.Client, key, holder string) (*IndexLock, error) {
+	token, err := acquireLockScript.Run(ctx, rds,
+		[]string{key, fenceKeyOf(key)},
+		holder, indexLockTTL.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if token == 0 {
+		return nil, nil
+	}
+
+	l := &IndexLock{
+		rds:    rds,
+		key:    key,
+		Holder: holder,
+		Token:  token,
+		done:   make(chan struct{}),
+	}
+	l.ctx, l.cancel = context.WithCancel(withFence(ctx, fenceKeyOf(key), token))
+	go l.renew()
+	return l, nil
+}
+
+// acquireLock ждёт, пока блокировка key освободится, и берёт её
+func acquireLock(ctx context.Context, rds *redis.Client, key, holder string) (*IndexLock, error) {
+	for {
+		l, err := tryLock(ctx, rds, key, holder)
+		if err != nil || l != nil {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(indexLockPoll):
+		}
+	}
+}
+
+// Context отменяется, когда блокировка потеряна или отпущена; несёт токен ограждения
+func (l *IndexLock) Context() context.Context {
+	return l.ctx
+}
+
+func (l *IndexLock) value() string {
+	return l.Holder + " " + strconv.FormatInt(l.Token, 10)
+}
+
+// renew продлевает блокировку, пока она не отпущена
+func (l *IndexLock) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(indexLockRenew)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ok, err := renewLockScript.Run(Ctx, l.rds,
+			[]string{l.key}, l.value(), indexLockTTL.Milliseconds(),
+		).Int64()
+		if err != nil {
+			log.Printf("[Lock] %s: ошибка продления: %v", l.key, err)
+			// сетевой сбой: блокировка жива до истечения TTL, пробуем снова;
+			// если до следующей попытки она истечёт, лидером себя больше не считаем
+			if time.Since(renewed)+indexLockRenew >= indexLockTTL {
+				log.Printf("[Lock] %s: не продлена за TTL, блокировка считается потерянной (токен %d)", l.key, l.Token)
+				l.cancel()
+				return
+			}
+			continue
+		}
+		if ok == 0 {
+			log.Printf("[Lock] %s: блокировка потеряна (токен %d)", l.key, l.Token)
+			l.cancel()
+			return
+		}
+		renewed = time.Now()
+	}
+}
+
+// Release останавливает продление и удаляет блокировку, если она ещё наша
+func (l *IndexLock) Release() {
+	l.cancel()
+	<-l.done
+	if err := releaseLockScript.Run(Ctx, l.rds, []string{l.key}, l.value()).Err(); err != nil {
+		log.Printf("[Lock] %s: ошибка освобождения: %v", l.key, err)
+	}
+}
+
+// IndexLeader — кто держит блокировку коллекции: держатель, токен и оставшийся TTL.
+// Пустой holder — блокировка свободна.
+func IndexLeader(ctx context.Context, rds *redis.Client, collection string) (holder string, token int64, ttl time.Duration, err error) {
+	v, err := rds.Get(ctx, IndexLockKey(collection)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", 0, 0, nil
+	}
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if i := strings.LastIndexByte(v, ' '); i >= 0 {
+		holder = v[:i]
+		token, _ = strconv.ParseInt(v[i+1:], 10, 64)
+	} else {
+		holder = v
+	}
+	ttl, err = rds.PTTL(ctx, IndexLockKey(collection)).Result()
+	return holder, token, ttl, err
+}
+
+// leadershipStatus описывает держателей блокировок индексатора для /ps
+func leadershipStatus(rds *redis.Client) string {
+	var b strings.Builder
+	b.WriteString("\n👑 Индексаторы\n")
+	me := InstanceName()
+	for _, p := range Products() {
+		holder, token, ttl, err := IndexLeader(Ctx, rds, p.FragmentCollection)
+		switch {
+		case err != nil:
+			fmt.Fprintf(&b, "• %s: ошибка Redis\n", p.ID)
+		case holder == "":
+			fmt.Fprintf(&b, "• %s: свободно\n", p.ID)
+		default:
+			mark := ""
+			if holder == me {
+				mark = " (этот экземпляр)"
+			}
+			fmt.Fprintf(&b, "• %s: %s%s, токен %d, ещё %s\n",
+				p.ID, holder, mark, token, ttl.Round(time.Second))
+		}
+	}
+	return b.String()
+}
+
+type fenceCtxKey struct{}
+
+// fence — токен ограждения и счётчик, которым он выдан
+type fence struct {
+	key   string
+	token int64
+}
+
+// withFence прикладывает токен ограждения к контексту записей индекса
+func withFence(ctx context.Context, key string, token int64) context.Context {
+	return context.WithValue(ctx, fenceCtxKey{}, fence{key: key, token: token})
+}
+
+// fenceFrom — токен блокировки коллекции из контекста; 0 — запись без ограждения
+// (в контексте нет токена или он выдан другой блокировкой, например миграции)
+func fenceFrom(ctx context.Context, collection string) int64 {
+	f, _ := ctx.Value(fenceCtxKey{}).(fence)
+	if f.key != indexFenceKey(collection) {
+		return 0
+	}
+	return f.token
+}
@@ -2,143 +2,176 @@
 package botutils
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
-	"os"
+	"math"
 	"strconv"
+	"strings"
 	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/getgems"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
 const (
-	baseURL         = "https://api.getgems.io/public-api/v1/nft/history/"
-	defaultPrice    = 1.4
-	requestInterval = 770 * time.Millisecond
+	defaultPrice = 1.4
+
+	// ownerLookupTimeout ограничивает весь обход NFT владельца со всеми страницами
+	ownerLookupTimeout = 2 * time.Minute
+
+	// indexerPageTimeout — время на одну страницу истории с учётом повторов очереди
+	indexerPageTimeout = 5 * time.Minute
+
+	// ownerCheckInterval — как часто NFT владельца из индекса сверяются с API
+	ownerCheckInterval = 6 * time.Hour
 )
 
-type Response struct {
-	Response struct {
-		Items []Item `json:"items"`
-	} `json:"response"`
-	Success bool `json:"success"`
+// GetAveragePrice читает адреса из файла и возвращает среднюю цену всех NFT с кешированием
+func GetAveragePrice(
+	st Store,
+	collectionAddress string,
+) (float64, bool) {
+
+	sum, count, err := st.Aggregate(Ctx, collectionAddress)
+	if err != nil {
+		log.Println("❌ store aggregate error:", err)
+		return defaultPrice, false
+	}
+	if count == 0 {
+		log.Println("❌ в коллекции нет NFT с ценой")
+		return defaultPrice, false
+	}
+
+	avg := sum / float64(count)
+	return avg, true
+}
+
+// priceHistogramBins — сколько столбцов в гистограмме цен
+const priceHistogramBins = 8
+
+// PriceStats — распределение последних цен NFT коллекции
+type PriceStats struct {
+	Count                      int64
+	Min, Max                   float64
+	P10, P25, Median, P75, P90 float64
+	Histogram                  []PriceBin
 }
 
-type Item struct {
-	TypeData struct {
-		Type  string `json:"type"`
-		Price string `json:"price,omitempty"`
-	} `json:"typeData"`
+// PriceBin — столбец гистограммы: NFT с ценой в [From, To), последний включает To
+type PriceBin struct {
+	From, To float64
+	Count    int64
 }
 
-// Получение последней цены по адресу NFT с кешированием
-func getLastPrice(address string) float64 {
-	url := fmt.Sprintf("%s%s?limit=1&types=mint&types=sold", baseURL, address)
-	req, err := http.NewRequest("GET", url, nil)
+// GetPriceStats считает медиану, перцентили и гистограмму по отсортированным ценам NFT.
+// Перцентиль — линейная интерполяция между соседними по рангу ценами.
+// Столбцы гистограммы равной ширины лежат между p10 и p90, крайние захватывают
+// хвосты до минимума и максимума, чтобы единичные выбросы не сжимали остальные столбцы.
+func GetPriceStats(st Store, collectionAddress string) (*PriceStats, error) {
+	ctx := Ctx
+	n, err := st.PriceCountBetween(ctx, collectionAddress, math.Inf(-1), math.Inf(1))
 	if err != nil {
-		log.Println("❌ Ошибка создания запроса:", err)
-		return defaultPrice
+		return nil, err
 	}
-	req.Header.Add("accept", "application/json")
-	apiKey := os.Getenv("GETGEMS_TOKEN")
-	req.Header.Add("Authorization", apiKey)
-	resp, err := apiqueue.Queue.Enqueue(req, apiqueue.Low)
-	if err != nil {
-		log.Println("❌ Ошибка HTTP-запроса:", err)
-		return defaultPrice
+	stats := &PriceStats{Count: n}
+	if n == 0 {
+		return stats, nil
 	}
-	defer resp.Body.Close()
 
-	var result Response
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Println("❌ Ошибка декодирования JSON:", err)
-		return defaultPrice
+	quantile := func(q float64) (float64, error) {
+		pos := q * float64(n-1)
+		lo := int64(math.Floor(pos))
+		prices, err := st.PriceRange(ctx, collectionAddress, lo, lo+1)
+		if err != nil || len(prices) == 0 {
+			return 0, err
+		}
+		if len(prices) == 1 {
+			return prices[0], nil
+		}
+		return prices[0] + (prices[1]-prices[0])*(pos-float64(lo)), nil
+	}
+	for _, q := range []struct {
+		dst *float64
+		q   float64
+	}{
+		{&stats.Min, 0}, {&stats.P10, 0.1}, {&stats.P25, 0.25}, {&stats.Median, 0.5},
+		{&stats.P75, 0.75}, {&stats.P90, 0.9}, {&stats.Max, 1},
+	} {
+		if *q.dst, err = quantile(q.q); err != nil {
+			return nil, err
+		}
 	}
 
-	if len(result.Response.Items) == 0 {
-		log.Printf("⚠️ Нет истории для NFT %s, используем defaultPrice %.2f\n", address, defaultPrice)
-		return defaultPrice
+	edges := []float64{stats.Min}
+	if inner := priceHistogramBins - 2; stats.P90 > stats.P10 {
+		width := (stats.P90 - stats.P10) / float64(inner)
+		for i := 0; i <= inner; i++ {
+			edges = append(edges, stats.P10+width*float64(i))
+		}
 	}
+	edges = append(edges, stats.Max)
 
-	lastItem := result.Response.Items[0]
-	var price float64
-	switch lastItem.TypeData.Type {
-	case "sold":
-		price, err = strconv.ParseFloat(lastItem.TypeData.Price, 64)
-		if err != nil || price <= 0 {
-			log.Printf("⚠️ Некорректная цена для NFT %s, используем defaultPrice %.2f\n", address, defaultPrice)
-			price = defaultPrice
+	for i := 0; i+1 < len(edges); i++ {
+		from, to := edges[i], edges[i+1]
+		if to <= from && i+2 < len(edges) {
+			continue // минимум совпал с p10 — пустой столбец
 		}
-	case "mint":
-		price = defaultPrice
-	default:
-		log.Printf("⚠️ Неизвестный тип транзакции '%s' для NFT %s, используем defaultPrice %.2f\n",
-			lastItem.TypeData.Type, address, defaultPrice)
-		price = defaultPrice
+		upper := to
+		if i+2 == len(edges) {
+			upper = math.Inf(1) // последний столбец включает максимум
+		}
+		count, err := st.PriceCountBetween(ctx, collectionAddress, from, upper)
+		if err != nil {
+			return nil, err
+		}
+		stats.Histogram = append(stats.Histogram, PriceBin{From: from, To: to, Count: count})
 	}
-	return price
+	return stats, nil
 }
 
-// GetAveragePrice читает адреса из файла и возвращает среднюю цену всех NFT с кешированием
-func GetAveragePrice(
-	rdb *redis.Client,
-	collectionAddress string,
-) (float64, bool) {
-
-	sumKey := "collection:sum:" + collectionAddress
-	countKey := "collection:count:" + collectionAddress
-
-	sum, err := rdb.Get(Ctx, sumKey).Float64()
-	if err != nil {
-		log.Println("❌ redis sum error:", err)
-		return defaultPrice, false
+// String — гистограмма для текстовой сводки: столбец из █ на строку
+func (s *PriceStats) String() string {
+	var max int64
+	for _, b := range s.Histogram {
+		if b.Count > max {
+			max = b.Count
+		}
 	}
-
-	count, err := rdb.Get(Ctx, countKey).Int64()
-	if err != nil || count == 0 {
-		log.Println("❌ redis count error:", err)
-		return defaultPrice, false
+	var out strings.Builder
+	for _, b := range s.Histogram {
+		bar := 0
+		if max > 0 {
+			bar = int(math.Round(10 * float64(b.Count) / float64(max)))
+		}
+		fmt.Fprintf(&out, "%.2f–%.2f %s %d\n", b.From, b.To, strings.Repeat("█", bar), b.Count)
 	}
-
-	avg := sum / float64(count)
-	return avg, true
+	return out.String()
 }
 
-type CollectionHistoryResponse struct {
-	Success  bool `json:"success"`
-	Response struct {
-		Cursor string                `json:"cursor"`
-		Items  []CollectionHistoryItem `json:"items"`
-	} `json:"response"`
+// salesKey — счётчик продаж коллекции за период (day/week/month)
+func salesKey(collection, period, bucket string) string {
+	return "collection:sales:" + collection + ":" + period + ":" + bucket
 }
 
-type CollectionHistoryItem struct {
-	Address           string `json:"address"`
-	Name              string `json:"name"`
-	Time              string `json:"time"`
-	Timestamp         int64  `json:"timestamp"`
-	CollectionAddress string `json:"collectionAddress"`
-	Lt                string `json:"lt"`
-	Hash              string `json:"hash"`
-	IsOffchain        bool   `json:"isOffchain"`
-	TypeData          TypeData `json:"typeData"`
+// saleStreamKey — поток новых продаж коллекции для уведомлений
+func saleStreamKey(collection string) string {
+	return "collection:sales_stream:" + collection
 }
 
-type TypeData struct {
-	Type                 string `json:"type"`
-	Price                string `json:"price"`      // "1.4"
-	PriceNano            string `json:"priceNano"`  // "1400000000"
-	NewOwner             string `json:"newOwner"`
-	OldOwner             string `json:"oldOwner"`
-	RejectFromGlobalTop  bool   `json:"rejectFromGlobalTop"`
-	Currency             string `json:"currency"`   // "TON"
-}
+const (
+	// saleGroup — группа потребителей потока продаж: каждую продажу
+	// уведомляет один экземпляр бота
+	saleGroup = "notifier"
+	// saleStreamMaxLen — примерная длина потока, старые записи обрезаются
+	saleStreamMaxLen = 10000
+	// saleClaimIdle — через сколько неподтверждённую продажу забирает другой потребитель
+	saleClaimIdle = time.Minute
+	// saleReadBlock — сколько ReadSale ждёт новую продажу
+	saleReadBlock = 5 * time.Second
+	// saleMaxDeliveries — после стольких неудачных доставок продажа отбрасывается
+	saleMaxDeliveries = 10
+)
 
 func dayKey(ts int64) string {
 	t := time.UnixMilli(ts).UTC()
@@ -155,7 +188,7 @@ func weekKey(ts int64) string {
 	year, week := t.ISOWeek()
 	return fmt.Sprintf("%d%02d", year, week)
 }
-func extractPrice(item CollectionHistoryItem) (float64, bool) {
+func extractPrice(item getgems.HistoryItem) (float64, bool) {
 	if item.TypeData.Type != "sold" {
 		return 0, false
 	}
@@ -186,369 +219,375 @@ func extractPrice(item CollectionHistoryItem) (float64, bool) {
 	return 0, false
 }
 
-func GetCollectionHistory(
-	collectionAddress string,
-	cursor string,
-) (*CollectionHistoryResponse, error) {
+// listingPrice — цена выставления в его валюте. priceNano берём только для TON:
+// у жетонов другое число знаков после запятой.
+func listingPrice(item getgems.HistoryItem) (float64, bool) {
+	if item.TypeData.Price != "" {
+		price, err := strconv.ParseFloat(item.TypeData.Price, 64)
+		return price, err == nil
+	}
+	if item.TypeData.PriceNano != "" && item.TypeData.Currency == "TON" {
+		nano, err := strconv.ParseInt(item.TypeData.PriceNano, 10, 64)
+		return float64(nano) / 1e9, err == nil
+	}
+	return 0, false
+}
 
-	baseURL := "https://api.getgems.io/public-api/v1/collection/history/" + collectionAddress
+// applyNftState переносит в событие изменение владельца, выставления и предложений NFT
+func applyNftState(ev *IndexEvent, item getgems.HistoryItem) {
+	switch item.TypeData.Type {
+	case getgems.TypeMint:
+		ev.Owner = item.TypeData.NewOwner
+	case getgems.TypeSold:
+		ev.Owner = item.TypeData.NewOwner
+		ev.Delist = true
+		// продажа по предложению закрывает его
+		ev.Offer = &Offer{Buyer: item.TypeData.NewOwner, Since: item.Timestamp, Cancelled: true}
+	case getgems.TypeTransfer:
+		ev.Owner = item.TypeData.NewOwner
+		ev.Delist = true
+	case getgems.TypeOffer:
+		price, ok := listingPrice(item)
+		if !ok {
+			return
+		}
+		ev.Offer = &Offer{
+			Buyer:    offerBuyer(item),
+			Price:    price,
+			Currency: item.TypeData.Currency,
+			Since:    item.Timestamp,
+		}
+	case getgems.TypeCancelOffer:
+		ev.Offer = &Offer{Buyer: offerBuyer(item), Since: item.Timestamp, Cancelled: true}
+	case getgems.TypePutUpForSale, getgems.TypePutUpForAuction:
+		// повторное выставление — это смена цены: заменяет предыдущее
+		price, ok := listingPrice(item)
+		if !ok {
+			return
+		}
+		kind := "sale"
+		if item.TypeData.Type == getgems.TypePutUpForAuction {
+			kind = "auction"
+		}
+		seller := item.TypeData.OldOwner
+		if seller == "" {
+			seller = item.TypeData.NewOwner
+		}
+		ev.Listing = &Listing{
+			Kind:     kind,
+			Price:    price,
+			Currency: item.TypeData.Currency,
+			Seller:   seller,
+			Since:    item.Timestamp,
+		}
+	case getgems.TypeCancelSale, getgems.TypeCancelAuction, getgems.TypeBurn:
+		ev.Delist = true
+	}
+}
 
-	q := url.Values{}
-	q.Set("limit", "100")
-	q.Set("reverse", "true")
-	if  cursor != "" {
-		q.Set("after", cursor)
+// offerBuyer — автор предложения: будущий владелец NFT
+func offerBuyer(item getgems.HistoryItem) string {
+	if item.TypeData.NewOwner != "" {
+		return item.TypeData.NewOwner
 	}
+	return item.TypeData.OldOwner
+}
 
-	q.Add("types", "mint")
-	q.Add("types", "sold")
+// collectionHistoryQuery — история коллекции для индексатора: все типы событий
+// (пустой Types), чтобы знать владельцев и выставления, а не только цены
+var collectionHistoryQuery = getgems.HistoryQuery{
+	Limit:   100,
+	Reverse: true,
+}
 
-	reqURL := baseURL + "?" + q.Encode()
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return nil, err
+// collectionHistoryPages — итератор истории коллекции для индексатора
+func collectionHistoryPages(collectionAddress string) *getgems.Iterator[getgems.HistoryItem] {
+	return gg().CollectionHistoryPages(collectionAddress, collectionHistoryQuery)
+}
+
+// appliedEventsKey — множество id событий коллекции, уже применённых индексатором
+func appliedEventsKey(collection string) string {
+	return "collection:applied:" + collection
+}
+
+// eventID однозначно определяет событие истории: lt и hash транзакции.
+// У офчейн-событий их может не быть — тогда берём адрес, тип и время.
+func eventID(item getgems.HistoryItem) string {
+	if item.Lt != "" || item.Hash != "" {
+		return item.Lt + ":" + item.Hash
 	}
+	return fmt.Sprintf("%s:%s:%d", item.Address, item.TypeData.Type, item.Timestamp)
+}
 
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("Authorization", os.Getenv("GETGEMS_TOKEN"))
+// saleEventJSON — продажа в формате очереди уведомлений; nil, если не удалось сериализовать
+func saleEventJSON(item getgems.HistoryItem, price float64) []byte {
+	saleEvent := struct {
+		Address   string  `json:"address"`
+		Name      string  `json:"name"`
+		Price     float64 `json:"price"`
+		NewOwner  string  `json:"newowner"`
+		Timestamp int64   `json:"timestamp"`
+	}{
+		Address:   item.Address,
+		Name:      item.Name,
+		Price:     price,
+		NewOwner:  item.TypeData.NewOwner,
+		Timestamp: item.Timestamp,
+	}
 
-	resp, err := apiqueue.Queue.Enqueue(req, apiqueue.Low)
+	saleJSON, err := json.Marshal(saleEvent)
 	if err != nil {
-		return nil, err
+		log.Printf("[Indexer] error marshal sale event: %v", err)
+		return nil
 	}
-	defer resp.Body.Close()
+	return saleJSON
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf(
-			"collection history error %d: %s",
-			resp.StatusCode, string(body),
-		)
-	}
+// UpdateCollectionIndex догоняет историю коллекции. ctx — контекст блокировки
+// индексатора: с её потерей индексация останавливается, а записи отклоняются.
+// Пока первичный проход не завершён, за вызов проходит одна его порция, а новые
+// события подбираются с головы истории; more — первичный проход ещё не закончен.
+func UpdateCollectionIndex(
+	ctx context.Context,
+	st Store,
+	collectionAddress string,
+) (more bool, err error) {
 
-	var result CollectionHistoryResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	processName := "collection_indexing:" + collectionAddress
+
+	indexed, err := st.Flag(ctx, collectionAddress, flagIndexed)
+	if err != nil {
+		return false, err
 	}
+	if !indexed {
+		return backfillStep(ctx, st, collectionAddress)
+	}
+
+	log.Println("[Indexer] Последующая индексация")
+	st.SetStatus(ctx, processName, "running")
+	defer st.SetStatus(ctx, processName, "idle")
 
-	if !result.Success {
-		return nil, fmt.Errorf("collection history returned success=false")
+	maxTS, _, err := replayHistory(ctx, st, collectionAddress, apiqueue.Indexer, true, nil)
+	if err != nil {
+		return false, err
 	}
 
-	return &result, nil
+	log.Printf("[Indexer] Индексация завершена, lastTS=%d", maxTS)
+
+	return false, nil
 }
 
+// historyPage — сводка по обработанной странице истории для onPage
+type historyPage struct {
+	Applied int   // применено новых событий
+	FirstTS int64 // время первого события страницы
+	LastTS  int64 // время последнего события страницы
+}
 
-func UpdateCollectionIndex(
-	rds *redis.Client,
+// replayHistory проходит историю коллекции с сохранённого в st курсора и применяет
+// события к st. notify — публиковать продажи в очередь уведомлений;
+// onPage вызывается после каждой обработанной страницы и может остановить проход,
+// вернув false. Возвращает время последнего события и дошёл ли проход до конца истории.
+func replayHistory(
+	ctx context.Context,
+	st Store,
 	collectionAddress string,
-) error {
-
-	processKey := "process:collection_indexing"
-	SetValue(rds, processKey, "running")
-	defer SetValue(rds, processKey, "idle")
-	primaryKey := "collection:" + collectionAddress + ":primary_index_done"
-
-	isFirst := false
-	exists, _ := rds.Exists(Ctx, primaryKey).Result()
-	if exists == 0 {
-		isFirst = true
-		log.Println("[Indexer] Первая индексация")
-	}else{
-		log.Println("[Indexer] Последующая индексация")
-	}
-	ctx := Ctx
+	priority apiqueue.RequestPriority,
+	notify bool,
+	onPage func(historyPage) bool,
+) (maxTS int64, done bool, err error) {
+	mintPrice := mintPriceFor(collectionAddress)
 
 	// --- lastTS ---
-	lastTS, err := rds.Get(ctx, "collection:last_ts:"+collectionAddress).Int64()
+	lastTS, err := st.LastTS(ctx, collectionAddress)
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			lastTS = 0
-			log.Printf("[Indexer] Нет lastTS в Redis, начнем с 0")
-		} else {
-			return err
-		}
+		return 0, false, err
+	}
+	if lastTS == 0 {
+		log.Printf("[Indexer] Нет lastTS, начнем с 0")
 	}
 
-	cursor, _ := rds.Get(ctx, "collection:cursor:"+collectionAddress).Result()
-	var cursorPtr *string
-	if cursor != "" {
-		cursorPtr = &cursor
+	cursor, err := st.Cursor(ctx, collectionAddress)
+	if err != nil {
+		return 0, false, err
 	}
 
-	maxTS := lastTS
-	page := 1
+	maxTS = lastTS
+	pages := collectionHistoryPages(collectionAddress).Resume(cursor)
 
 	for {
+		pageCursor := pages.Cursor()
 		log.Printf(
-			"[Indexer] Загружаем страницу %d, cursor=%v",
-			page, cursorPtr,
+			"[Indexer] Загружаем страницу %d, cursor=%q",
+			pages.Pages()+1, pageCursor,
 		)
 
-		resp, err := GetCollectionHistory(collectionAddress, cursor)
-		if err != nil {
-			return err
+		pageCtx, cancel := context.WithTimeout(getgems.WithPriority(ctx, priority), indexerPageTimeout)
+		ok := pages.Next(pageCtx)
+		cancel()
+		if err := pages.Err(); err != nil {
+			return 0, false, err
 		}
-
-		if len(resp.Response.Items) == 0 {
+		if !ok {
 			log.Printf("[Indexer] Пустая страница")
+			done = true
 			break
 		}
 
-		for _, item := range resp.Response.Items {
-			addr := item.Address
-
+		page := pages.Page()
+		summary := historyPage{FirstTS: page[0].Timestamp, LastTS: page[len(page)-1].Timestamp}
+		for i, item := range page {
 			// --- обновляем maxTS ---
 			if item.Timestamp > maxTS {
 				maxTS = item.Timestamp
 			}
 
-			switch item.TypeData.Type {
-
-			case "mint":
-				priceKey := fmt.Sprintf("nft:last_price:%s:%s", collectionAddress, addr)
-
-				// ⚠️ ставим цену ТОЛЬКО если её нет
-				ok, err := rds.SetNX(ctx, priceKey, 1.4, 0).Result()
-				if err != nil {
-					return err
-				}
-				if ok {
-					log.Printf("[Indexer][mint] NFT %s — %s, price=1.4", addr, item.Name)
-				} else {
-					log.Printf("[Indexer][mint] NFT %s — %s, цена уже есть", addr, item.Name)
-				}
-				sumKey := "collection:sum:" + collectionAddress
-				countKey := "collection:count:" + collectionAddress
-
-				pipe := rds.TxPipeline()
-				pipe.IncrByFloat(ctx, sumKey, 1.4)
-				pipe.Incr(ctx, countKey)
-				if _, err := pipe.Exec(ctx); err != nil {
-					return err
-				}
-
-			case "sold":
-				price, ok := extractPrice(item)
-				if !ok {
-					continue
-				}
-
-				priceKey := fmt.Sprintf("nft:last_price:%s:%s", collectionAddress, addr)
-
-				oldPrice, err := rds.Get(ctx, priceKey).Float64()
-				if err != nil {
-					if errors.Is(err, redis.Nil) {
-						oldPrice = 0
-					} else {
-						return err
-					}
-				}
-
-				if oldPrice == price {
-					continue
-				}
-
-				if err := rds.Set(ctx, priceKey, price, 0).Err(); err != nil {
-					return err
-				}
-
-				sumKey := "collection:sum:" + collectionAddress
-				countKey := "collection:count:" + collectionAddress
-
-				pipe := rds.TxPipeline()
-				if oldPrice == 0 {
-					pipe.Incr(ctx, countKey)
-					pipe.IncrByFloat(ctx, sumKey, price)
-				} else {
-					pipe.IncrByFloat(ctx, sumKey, price-oldPrice)
-				}
-				if _, err := pipe.Exec(ctx); err != nil {
-					return err
-				}
-
-				day := dayKey(item.Timestamp)
-				week := weekKey(item.Timestamp)
-				month := monthKey(item.Timestamp)
-
-				pipe2 := rds.TxPipeline()
-				pipe2.Incr(ctx, "collection:sales:day:"+day)
-				pipe2.Incr(ctx, "collection:sales:week:"+week)
-				pipe2.Incr(ctx, "collection:sales:month:"+month)
-				if _, err := pipe2.Exec(ctx); err != nil {
-					return err
-				}
-				
-				if !isFirst {
-					saleEvent := struct {
-						Address   string  `json:"address"`
-						Name      string  `json:"name"`
-						Price     float64 `json:"price"`
-						NewOwner  string  `json:"newowner"`
-						Timestamp int64   `json:"timestamp"`
-					}{
-						Address:   addr,
-						Name:      item.Name,
-						Price:     price,
-						NewOwner: item.TypeData.NewOwner,
-						Timestamp: item.Timestamp,
-					}
-
-					saleJSON, err := json.Marshal(saleEvent)
-					if err != nil {
-						log.Printf("[Indexer] error marshal sale event: %v", err)
-					} else {
-						if err := rds.RPush(ctx, "collection:new_sales", saleJSON).Err(); err != nil {
-							log.Printf("[Indexer] error push sale to queue: %v", err)
-						}
-					}
-				}
-				log.Printf(
-					"[Indexer][sold] NFT %s — %s, old=%.4f new=%.4f",
-					addr, item.Name, oldPrice, price,
-				)
-
+			// курсор двигается вместе с событием: после сбоя страница
+			// повторится с начала, а уже учтённые события отсеет дедупликация
+			resume := pageCursor
+			if i == len(page)-1 {
+				resume = pages.Cursor()
+			}
+			applied, err := applyHistoryItem(ctx, st, collectionAddress, item, resume, mintPrice, notify)
+			if err != nil {
+				return 0, false, err
+			}
+			if applied {
+				summary.Applied++
 			}
 		}
 
+		// страница могла не содержать применимых событий — курсор всё равно двигаем
+		if err := st.SetCursor(ctx, collectionAddress, pages.Cursor()); err != nil {
+			return 0, false, err
+		}
+
 		// --- cursor ---
-		if resp.Response.Cursor == "" {
+		if pages.Done() {
 			log.Printf("[Indexer] Конец истории")
+			done = true
+		}
+		stop := onPage != nil && !onPage(summary)
+		if done || stop {
 			break
 		}
-
-		// обновляем cursor для следующей страницы
-		cursor = resp.Response.Cursor
-
-		// сохраняем в Redis
-		rds.Set(ctx, "collection:cursor:"+collectionAddress, cursor, 0)
-		if isFirst {
-					rds.Set(ctx, primaryKey, "true", 0)
-				}
-		page++
 	}
 
 	// --- сохраняем lastTS ---
-	if err := rds.Set(ctx, "collection:last_ts:"+collectionAddress, maxTS, 0).Err(); err != nil {
-		return err
+	if err := st.SetLastTS(ctx, collectionAddress, maxTS); err != nil {
+		return 0, false, err
 	}
 
-	rds.Set(ctx, "collection:"+collectionAddress+":indexed", "true", 0)
+	return maxTS, done, nil
+}
 
-	log.Printf("[Indexer] Индексация завершена, lastTS=%d", maxTS)
+// applyHistoryItem применяет одно событие истории; resume — курсор, с которого
+// продолжить после него (пусто — не двигать). Возвращает false, если событие уже было учтено.
+func applyHistoryItem(
+	ctx context.Context,
+	st Store,
+	collectionAddress string,
+	item getgems.HistoryItem,
+	resume string,
+	mintPrice float64,
+	notify bool,
+) (bool, error) {
+	addr := item.Address
+	ev := IndexEvent{
+		ID:        eventID(item),
+		Type:      item.TypeData.Type,
+		Address:   addr,
+		Timestamp: item.Timestamp,
+		Resume:    resume,
+		Name:      item.Name,
+		Currency:  item.TypeData.Currency,
+		NewOwner:  item.TypeData.NewOwner,
+		OldOwner:  item.TypeData.OldOwner,
+		Lt:        item.Lt,
+		Hash:      item.Hash,
+	}
 
-	return nil
-}
+	// в цену и агрегаты идут только минт и продажа в TON;
+	// остальные события меняют владельца и выставления
+	applyNftState(&ev, item)
+	switch item.TypeData.Type {
+	case getgems.TypeMint:
+		ev.HasPrice = true
+		ev.Price = mintPrice
+	case getgems.TypeSold:
+		if price, ok := extractPrice(item); ok {
+			ev.HasPrice = true
+			ev.Price = price
+			if notify {
+				ev.Sale = saleEventJSON(item, price)
+			}
+		}
+	}
 
+	applied, oldPrice, err := st.ApplyEvent(ctx, collectionAddress, ev)
+	if err != nil {
+		return false, err
+	}
+	if !applied {
+		log.Printf("[Indexer] событие %s уже учтено, пропускаем", ev.ID)
+		return false, nil
+	}
 
-type OwnerNftsResponse struct {
-	Success bool `json:"success"`
-	Response struct {
-		Cursor *string `json:"cursor"`
-		Items  []struct {
-			Address           string `json:"address"`
-			CollectionAddress string `json:"collectionAddress"`
-			Name              string `json:"name"`
-		} `json:"items"`
-	} `json:"response"`
+	switch {
+	case item.TypeData.Type == getgems.TypeMint:
+		log.Printf("[Indexer][mint] NFT %s — %s, price=%g", addr, item.Name, mintPrice)
+	case ev.HasPrice:
+		log.Printf(
+			"[Indexer][sold] NFT %s — %s, old=%.4f new=%.4f",
+			addr, item.Name, oldPrice, ev.Price,
+		)
+	default:
+		log.Printf("[Indexer][%s] NFT %s — %s", item.TypeData.Type, addr, item.Name)
+	}
+	return true, nil
 }
 
+// GetOwnerAvgBuyPrice — средняя последняя цена NFT владельца в коллекции.
+// После первичной индексации NFT владельца берутся из индекса, а раз в ownerCheckInterval
+// набор сверяется с API в фоне; до неё — обходом API с приоритетом priority.
 func GetOwnerAvgBuyPrice(
-	rds *redis.Client,
+	ctx context.Context,
+	st Store,
+	collectionAddress string,
 	ownerAddress string,
+	priority apiqueue.RequestPriority,
 ) (avg float64, count int, err error) {
 
-	ctx := Ctx
 	var sum float64
 	var total int
 
-	collectionAddress := os.Getenv("COLLECTION_ADDRESS")
-	cursor := ""
-
 	log.Printf(
 		"[OwnerAvg] owner=%s collection=%s",
 		ownerAddress,
 		collectionAddress,
 	)
 
-	for {
-		u := fmt.Sprintf(
-			"https://api.getgems.io/public-api/v1/nfts/collection/%s/owner/%s?limit=100",
-			collectionAddress,
-			ownerAddress,
-		)
-		if cursor != "" {
-			u += "&after=" + url.QueryEscape(cursor)
-		}
-
-		log.Printf("[OwnerAvg] request: %s", u)
-
-		req, err := http.NewRequest("GET", u, nil)
-		if err != nil {
-			return 0, 0, err
-		}
-		req.Header.Add("accept", "application/json")
-		req.Header.Add("Authorization", os.Getenv("GETGEMS_TOKEN"))
+	addrs, err := OwnerNfts(ctx, st, collectionAddress, ownerAddress, priority)
+	if err != nil {
+		return 0, 0, err
+	}
+	log.Printf("[OwnerAvg] owner has %d NFTs", len(addrs))
 
-		resp, err := apiqueue.Queue.Enqueue(req, apiqueue.Low)
+	for _, addr := range addrs {
+		price, ok, err := st.NftPrice(ctx, collectionAddress, addr)
 		if err != nil {
 			return 0, 0, err
 		}
-
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		log.Printf("[OwnerAvg] status=%d body=%s", resp.StatusCode, string(body))
-
-		if resp.StatusCode != http.StatusOK {
-			return 0, 0, fmt.Errorf("getgems error %d", resp.StatusCode)
-		}
-
-		var data OwnerNftsResponse
-		if err := json.Unmarshal(body, &data); err != nil {
-			return 0, 0, err
-		}
-
-		log.Printf(
-			"[OwnerAvg] received %d NFTs",
-			len(data.Response.Items),
-		)
-
-		for _, nft := range data.Response.Items {
+		if !ok {
 			log.Printf(
-				"[OwnerAvg] nft=%s name=%s",
-				nft.Address,
-				nft.Name,
+				"[OwnerAvg] no price in store for nft=%s",
+				addr,
 			)
-
-			priceKey := fmt.Sprintf("nft:last_price:%s:%s", collectionAddress, nft.Address,)
-			price, err := rds.Get(ctx, priceKey).Float64()
-			
-			if err != nil {
-				if errors.Is(err, redis.Nil) {
-					log.Printf(
-						"[OwnerAvg] no price in redis for nft=%s",
-						nft.Address,
-					)
-					continue
-				}
-				return 0, 0, err
-			}
-
-			log.Printf(
-				"[OwnerAvg] matched nft=%s price=%.4f",
-				nft.Address,
-				price,
-			)
-
-			sum += price
-			total++
+			continue
 		}
 
-		if data.Response.Cursor == nil || *data.Response.Cursor == "" {
-			break
-		}
-		cursor = *data.Response.Cursor
+		sum += price
+		total++
 	}
 
 	if total == 0 {
@@ -566,3 +605,111 @@ func GetOwnerAvgBuyPrice(
 
 	return avg, total, nil
 }
+
+// OwnerNfts — адреса NFT коллекции у владельца. Пока коллекция не проиндексирована,
+// их отдаёт API; потом — индекс, а сверка с API раз в ownerCheckInterval идёт в фоне.
+func OwnerNfts(
+	ctx context.Context,
+	st Store,
+	collectionAddress string,
+	ownerAddress string,
+	priority apiqueue.RequestPriority,
+) ([]string, error) {
+	indexed, err := st.Flag(ctx, collectionAddress, flagIndexed)
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		return fetchOwnerNfts(ctx, collectionAddress, ownerAddress, priority)
+	}
+
+	addrs, err := st.OwnerNfts(ctx, collectionAddress, ownerAddress)
+	if err != nil {
+		return nil, err
+	}
+	if due, err := st.ClaimOwnerCheck(ctx, collectionAddress, ownerAddress, ownerCheckInterval); err != nil {
+		log.Printf("[OwnerAvg] owner check claim error: %v", err)
+	} else if due {
+		go func() {
+			ctx, cancel := context.WithTimeout(Ctx, ownerLookupTimeout)
+			defer cancel()
+			if _, err := ReconcileOwner(ctx, st, collectionAddress, ownerAddress); err != nil {
+				log.Printf("[OwnerSync] owner=%s: %v", ownerAddress, err)
+			}
+		}()
+	}
+	return addrs, nil
+}
+
+// fetchOwnerNfts обходит NFT владельца через API
+func fetchOwnerNfts(
+	ctx context.Context,
+	collectionAddress string,
+	ownerAddress string,
+	priority apiqueue.RequestPriority,
+) ([]string, error) {
+	var addrs []string
+	pages := gg().OwnerNftPages(collectionAddress, ownerAddress, 100)
+	ctx = getgems.WithPriority(ctx, priority)
+	for pages.Next(ctx) {
+		for _, nft := range pages.Page() {
+			addrs = append(addrs, nft.Address)
+		}
+	}
+	return addrs, pages.Err()
+}
+
+// ReconcileOwner сверяет NFT владельца в индексе с API и исправляет расхождения:
+// NFT, которых API у владельца не знает (кроме выставленных им), остаются без
+// владельца до следующего события.
+// Возвращает число исправленных NFT.
+func ReconcileOwner(ctx context.Context, st Store, collectionAddress, ownerAddress string) (int, error) {
+	remote, err := fetchOwnerNfts(ctx, collectionAddress, ownerAddress, apiqueue.Backfill)
+	if err != nil {
+		return 0, err
+	}
+	local, err := st.OwnerNfts(ctx, collectionAddress, ownerAddress)
+	if err != nil {
+		return 0, err
+	}
+
+	inRemote := make(map[string]bool, len(remote))
+	for _, addr := range remote {
+		inRemote[addr] = true
+	}
+	inLocal := make(map[string]bool, len(local))
+	for _, addr := range local {
+		inLocal[addr] = true
+	}
+
+	fixed := 0
+	for _, addr := range remote {
+		if !inLocal[addr] {
+			if err := st.SetNftOwner(ctx, collectionAddress, addr, ownerAddress); err != nil {
+				return fixed, err
+			}
+			fixed++
+		}
+	}
+	for _, addr := range local {
+		if !inRemote[addr] {
+			// выставленная NFT лежит на контракте продажи, и API может не считать её за владельцем
+			listing, err := st.NftListing(ctx, collectionAddress, addr)
+			if err != nil {
+				return fixed, err
+			}
+			if listing != nil && listing.Seller == ownerAddress {
+				continue
+			}
+			if err := st.SetNftOwner(ctx, collectionAddress, addr, ""); err != nil {
+				return fixed, err
+			}
+			fixed++
+		}
+	}
+	if fixed > 0 {
+		log.Printf("[OwnerSync] owner=%s: исправлено %d NFT (индекс %d, API %d)",
+			ownerAddress, fixed, len(local), len(remote))
+	}
+	return fixed, nil
+}
@@ -0,0 +1,251 @@
+package botutils
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/getgems"
+)
+
+// handlerQueue отдаёт запросы клиента getgems обработчику напрямую, без сети и лимитов
+type handlerQueue struct {
+	handler http.Handler
+}
+
+func (q handlerQueue) EnqueueContext(ctx context.Context, req *http.Request, priority apiqueue.RequestPriority) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	q.handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+// useGetgems подменяет клиент getgems на время теста
+func useGetgems(t *testing.T, h http.Handler) {
+	t.Helper()
+	gg() // инициализация по требованию не должна затереть подмену
+	prev := getgemsClient
+	getgemsClient = getgems.NewClient(handlerQueue{h}, "")
+	t.Cleanup(func() { getgemsClient = prev })
+}
+
+// historyHandler отдаёт страницы истории коллекции по курсору after
+func historyHandler(t *testing.T, pages map[string]getgems.HistoryPage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Query().Get("after")]
+		if !ok {
+			t.Errorf("неожиданный запрос %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "response": page})
+	})
+}
+
+const (
+	testNft1 = "EQnft1"
+	testNft2 = "EQnft2"
+)
+
+// testCollection — коллекция фрагментов по умолчанию: цена минта берётся из её продукта
+func testCollection() string {
+	return DefaultProduct().FragmentCollection
+}
+
+func historyItem(typ, addr string, ts int64, newOwner, oldOwner string) getgems.HistoryItem {
+	return getgems.HistoryItem{
+		Address:   addr,
+		Name:      "Fragment " + addr,
+		Timestamp: ts,
+		Lt:        strconv.FormatInt(ts, 10),
+		Hash:      typ + addr,
+		TypeData: getgems.TypeData{
+			Type:     typ,
+			NewOwner: newOwner,
+			OldOwner: oldOwner,
+		},
+	}
+}
+
+func mintItem(addr string, ts int64, owner string) getgems.HistoryItem {
+	return historyItem(getgems.TypeMint, addr, ts, owner, "")
+}
+
+func soldItem(addr string, ts int64, from, to string, price float64) getgems.HistoryItem {
+	item := historyItem(getgems.TypeSold, addr, ts, to, from)
+	item.TypeData.Currency = "TON"
+	item.TypeData.PriceNano = strconv.FormatInt(int64(price*1e9), 10)
+	return item
+}
+
+func transferItem(addr string, ts int64, from, to string) getgems.HistoryItem {
+	return historyItem(getgems.TypeTransfer, addr, ts, to, from)
+}
+
+func listItem(addr string, ts int64, seller string, price float64) getgems.HistoryItem {
+	item := historyItem(getgems.TypePutUpForSale, addr, ts, "", seller)
+	item.TypeData.Currency = "TON"
+	item.TypeData.Price = strconv.FormatFloat(price, 'f', -1, 64)
+	return item
+}
+
+func offerItem(addr string, ts int64, buyer string, price float64) getgems.HistoryItem {
+	item := historyItem(getgems.TypeOffer, addr, ts, buyer, "")
+	item.TypeData.Currency = "TON"
+	item.TypeData.Price = strconv.FormatFloat(price, 'f', -1, 64)
+	return item
+}
+
+// approx сравнивает суммы цен: в них копится ошибка округления
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func applyItems(t *testing.T, st Store, items ...getgems.HistoryItem) {
+	t.Helper()
+	for _, item := range items {
+		if _, err := applyHistoryItem(Ctx, st, testCollection(), item, "", mintPriceFor(testCollection()), false); err != nil {
+			t.Fatalf("applyHistoryItem %s %s: %v", item.TypeData.Type, item.Address, err)
+		}
+	}
+}
+
+func TestApplyHistoryItemDedupe(t *testing.T) {
+	st := NewMemoryStore()
+	c := testCollection()
+	sold := soldItem(testNft1, 2000, "o1", "o2", 3)
+
+	for i, want := range []bool{true, false} {
+		applied, err := applyHistoryItem(Ctx, st, c, sold, "", 1.4, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != want {
+			t.Fatalf("применение %d: applied=%v, ожидалось %v", i+1, applied, want)
+		}
+	}
+
+	if n, _ := st.SalesCount(Ctx, c, "day", dayKey(2000)); n != 1 {
+		t.Errorf("продаж за день %d, ожидалась 1", n)
+	}
+	if sum, count, _ := st.Aggregate(Ctx, c); sum != 3 || count != 1 {
+		t.Errorf("агрегат %g/%d, ожидалось 3/1", sum, count)
+	}
+	if msg, _ := st.ReadSale(Ctx, c, "test"); msg == nil {
+		t.Error("продажа не попала в очередь уведомлений")
+	} else if next := st.nextSale(c); next != nil {
+		t.Errorf("повтор продажи попал в очередь: %s", next.Data)
+	}
+}
+
+func TestApplyHistoryItemOutOfOrder(t *testing.T) {
+	st := NewMemoryStore()
+	c := testCollection()
+
+	// история пришла задом наперёд: продажа, затем более старые передача и минт
+	applyItems(t, st,
+		soldItem(testNft1, 3000, "o1", "o2", 5),
+		transferItem(testNft1, 2000, "o0", "o1"),
+		mintItem(testNft1, 1000, "o0"),
+	)
+
+	if price, ok, _ := st.NftPrice(Ctx, c, testNft1); !ok || price != 5 {
+		t.Errorf("цена %g (%v), ожидалась цена продажи 5", price, ok)
+	}
+	if sum, count, _ := st.Aggregate(Ctx, c); sum != 5 || count != 1 {
+		t.Errorf("агрегат %g/%d, ожидалось 5/1", sum, count)
+	}
+	if owner, _, _ := st.NftOwner(Ctx, c, testNft1); owner != "o2" {
+		t.Errorf("владелец %q, ожидался o2", owner)
+	}
+	if holders, _ := st.HolderCount(Ctx, c); holders != 1 {
+		t.Errorf("держателей %d, ожидался 1", holders)
+	}
+}
+
+func TestApplyHistoryItemBurn(t *testing.T) {
+	st := NewMemoryStore()
+	c := testCollection()
+
+	applyItems(t, st,
+		mintItem(testNft1, 1000, "o1"),
+		mintItem(testNft2, 1100, "o1"),
+		listItem(testNft1, 1200, "o1", 4),
+		offerItem(testNft1, 1300, "b1", 2),
+		historyItem(getgems.TypeBurn, testNft1, 2000, "", "o1"),
+	)
+
+	if _, ok, _ := st.NftOwner(Ctx, c, testNft1); ok {
+		t.Error("у сожжённой NFT остался владелец")
+	}
+	if nfts, _ := st.OwnerNfts(Ctx, c, "o1"); len(nfts) != 1 || nfts[0] != testNft2 {
+		t.Errorf("NFT владельца %v, ожидалась только %s", nfts, testNft2)
+	}
+	if l, _ := st.NftListing(Ctx, c, testNft1); l != nil {
+		t.Errorf("у сожжённой NFT осталось выставление %+v", *l)
+	}
+	if offers, _ := st.NftOffers(Ctx, c, testNft1); len(offers) != 0 {
+		t.Errorf("у сожжённой NFT остались предложения %+v", offers)
+	}
+	if holders, _ := st.HolderCount(Ctx, c); holders != 1 {
+		t.Errorf("держателей %d, ожидался 1", holders)
+	}
+
+	// передача до сожжения, пришедшая позже, не возвращает владельца
+	applyItems(t, st, transferItem(testNft1, 1500, "o1", "o3"))
+	if _, ok, _ := st.NftOwner(Ctx, c, testNft1); ok {
+		t.Error("устаревшая передача вернула владельца сожжённой NFT")
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	c := testCollection()
+	useGetgems(t, historyHandler(t, map[string]getgems.HistoryPage{
+		"": {Cursor: "p2", Items: []getgems.HistoryItem{
+			mintItem(testNft1, 1000, "o1"),
+			mintItem(testNft2, 1100, "o2"),
+		}},
+		"p2": {Cursor: "", Items: []getgems.HistoryItem{
+			soldItem(testNft1, 3000, "o1", "o3", 2.5),
+			// повтор события с прошлой страницы
+			mintItem(testNft2, 1100, "o2"),
+		}},
+	}))
+
+	st := NewMemoryStore()
+	var applied []int
+	maxTS, done, err := replayHistory(Ctx, st, c, apiqueue.Indexer, false, func(p historyPage) bool {
+		applied = append(applied, p.Applied)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done || maxTS != 3000 {
+		t.Errorf("done=%v maxTS=%d, ожидалось true/3000", done, maxTS)
+	}
+	if len(applied) != 2 || applied[0] != 2 || applied[1] != 1 {
+		t.Errorf("применено по страницам %v, ожидалось [2 1]", applied)
+	}
+	if cursor, _ := st.Cursor(Ctx, c); cursor != "p2" {
+		t.Errorf("курсор %q, ожидался p2", cursor)
+	}
+	if lastTS, _ := st.LastTS(Ctx, c); lastTS != 3000 {
+		t.Errorf("lastTS %d, ожидалось 3000", lastTS)
+	}
+	if sum, count, _ := st.Aggregate(Ctx, c); !approx(sum, 3.9) || count != 2 {
+		t.Errorf("агрегат %g/%d, ожидалось 3.9/2", sum, count)
+	}
+
+	// повторный проход с сохранённого курсора ничего не задваивает
+	if _, _, err := replayHistory(Ctx, st, c, apiqueue.Indexer, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := st.SalesCount(Ctx, c, "day", dayKey(3000)); n != 1 {
+		t.Errorf("продаж за день %d после повтора, ожидалась 1", n)
+	}
+}
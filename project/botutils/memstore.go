@@ -0,0 +1,556 @@
+package botutils
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore — Store в памяти процесса: для тестов и запуска без Redis.
+// Данные не переживают перезапуск и не делятся между репликами.
+type MemoryStore struct {
+	mu          sync.Mutex
+	collections map[string]*memCollection
+	cache       map[string]memCached
+	last        map[string]float64
+	status      map[string]string
+	floor       map[string][]FloorSample // продукт → снимки по времени
+}
+
+// memCollection — состояние индекса одной коллекции
+type memCollection struct {
+	prices   map[string]float64
+	owners   map[string]string
+	eventTS  map[string]int64           // время последнего события NFT
+	priceTS  map[string]int64           // время последнего минта или продажи NFT
+	holdings map[string]map[string]bool // владелец → его NFT
+	checked  map[string]time.Time       // владелец → когда сверять с API снова
+	listings map[string]Listing
+	offers   map[string]map[string]Offer // NFT → покупатель → предложение или отзыв
+	sum      float64
+	count    int64
+	sales    map[string]int64                // period:bucket → продажи
+	candles  map[string]map[int64]*memCandle // разрешение → начало → свеча
+	applied  map[string]bool
+	cursor   string
+	lastTS   int64
+	backfill BackfillProgress
+	flags    map[string]bool
+
+	queue    []*SaleMessage          // ещё не выданные продажи
+	inflight map[string]*memInflight // выданные, но не подтверждённые
+	saleSeq  int64
+}
+
+// memCandle — свеча со временем сделок открытия и закрытия
+type memCandle struct {
+	Candle
+	openTS, closeTS int64
+}
+
+// memInflight — продажа, выданная потребителю и ждущая подтверждения
+type memInflight struct {
+	msg *SaleMessage
+	at  time.Time
+}
+
+type memCached struct {
+	value   float64
+	expires time.Time // нулевое — без срока
+}
+
+// NewMemoryStore создаёт пустое хранилище в памяти
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		collections: make(map[string]*memCollection),
+		cache:       make(map[string]memCached),
+		last:        make(map[string]float64),
+		status:      make(map[string]string),
+		floor:       make(map[string][]FloorSample),
+	}
+}
+
+// coll возвращает состояние коллекции, создавая его при первом обращении; вызывать под mu
+func (s *MemoryStore) coll(collection string) *memCollection {
+	c, ok := s.collections[collection]
+	if !ok {
+		c = &memCollection{
+			prices:   make(map[string]float64),
+			owners:   make(map[string]string),
+			eventTS:  make(map[string]int64),
+			offers:   make(map[string]map[string]Offer),
+			priceTS:  make(map[string]int64),
+			candles:  make(map[string]map[int64]*memCandle),
+			holdings: make(map[string]map[string]bool),
+			checked:  make(map[string]time.Time),
+			listings: make(map[string]Listing),
+			sales:    make(map[string]int64),
+			applied:  make(map[string]bool),
+			flags:    make(map[string]bool),
+			inflight: make(map[string]*memInflight),
+		}
+		s.collections[collection] = c
+	}
+	return c
+}
+
+func (s *MemoryStore) NftPrice(ctx context.Context, collection, address string) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.coll(collection).prices[address]
+	return v, ok, nil
+}
+
+func (s *MemoryStore) NftPrices(ctx context.Context, collection string) (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prices := make(map[string]float64, len(s.coll(collection).prices))
+	for addr, v := range s.coll(collection).prices {
+		prices[addr] = v
+	}
+	return prices, nil
+}
+
+func (s *MemoryStore) PriceRange(ctx context.Context, collection string, start, stop int64) ([]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prices := make([]float64, 0, len(s.coll(collection).prices))
+	for _, v := range s.coll(collection).prices {
+		prices = append(prices, v)
+	}
+	sort.Float64s(prices)
+	// отрицательные номера считаются с конца, как в ZRANGE
+	if start < 0 {
+		start = max(int64(len(prices))+start, 0)
+	}
+	if stop < 0 {
+		stop += int64(len(prices))
+	}
+	if stop >= int64(len(prices)) {
+		stop = int64(len(prices)) - 1
+	}
+	if start < 0 || start > stop {
+		return nil, nil
+	}
+	return prices[start : stop+1], nil
+}
+
+func (s *MemoryStore) PriceCountBetween(ctx context.Context, collection string, min, max float64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, v := range s.coll(collection).prices {
+		if v >= min && v < max {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Candles(ctx context.Context, collection, res string, from, to int64) ([]Candle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var candles []Candle
+	for start, cd := range s.coll(collection).candles[res] {
+		if start >= from && start < to {
+			candles = append(candles, cd.Candle)
+		}
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Start < candles[j].Start })
+	return candles, nil
+}
+
+func (s *MemoryStore) Aggregate(ctx context.Context, collection string) (float64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.coll(collection)
+	return c.sum, c.count, nil
+}
+
+func (s *MemoryStore) SetAggregate(ctx context.Context, collection string, sum float64, count int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.coll(collection)
+	c.sum, c.count = sum, count
+	return nil
+}
+
+func (s *MemoryStore) SalesCount(ctx context.Context, collection, period, bucket string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coll(collection).sales[period+":"+bucket], nil
+}
+
+// ApplyEvent повторяет логику applyEventScript под общей блокировкой
+func (s *MemoryStore) ApplyEvent(ctx context.Context, collection string, ev IndexEvent) (bool, float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.coll(collection)
+
+	if ev.Resume != "" {
+		c.cursor = ev.Resume
+	}
+	if c.applied[ev.ID] {
+		return false, 0, nil
+	}
+	c.applied[ev.ID] = true
+
+	if o := ev.Offer; o != nil {
+		if prev, ok := c.offers[ev.Address][o.Buyer]; !ok || prev.Since <= ev.Timestamp {
+			if c.offers[ev.Address] == nil {
+				c.offers[ev.Address] = make(map[string]Offer)
+			}
+			c.offers[ev.Address][o.Buyer] = *o
+		}
+	}
+
+	stale := ev.Timestamp < c.eventTS[ev.Address]
+	if !stale {
+		c.eventTS[ev.Address] = ev.Timestamp
+		if ev.Owner != "" {
+			c.setOwner(ev.Address, ev.Owner)
+		} else if ev.Type == "burn" {
+			c.setOwner(ev.Address, "")
+			delete(c.offers, ev.Address)
+		}
+		if ev.Listing != nil {
+			c.listings[ev.Address] = *ev.Listing
+		} else if ev.Delist {
+			delete(c.listings, ev.Address)
+		}
+	}
+
+	if !ev.HasPrice {
+		return true, 0, nil
+	}
+	old, known := c.prices[ev.Address]
+	priceStale := ev.Timestamp < c.priceTS[ev.Address]
+	if ev.Type == "mint" {
+		if !known && !priceStale {
+			c.priceTS[ev.Address] = ev.Timestamp
+			c.prices[ev.Address] = ev.Price
+			c.sum += ev.Price
+			c.count++
+		}
+		return true, 0, nil
+	}
+
+	if !priceStale {
+		c.priceTS[ev.Address] = ev.Timestamp
+	}
+	if old != ev.Price && !priceStale {
+		c.prices[ev.Address] = ev.Price
+		if old == 0 {
+			c.count++
+			c.sum += ev.Price
+		} else {
+			c.sum += ev.Price - old
+		}
+	}
+	c.sales["day:"+dayKey(ev.Timestamp)]++
+	c.sales["week:"+weekKey(ev.Timestamp)]++
+	c.sales["month:"+monthKey(ev.Timestamp)]++
+	for _, res := range candleResolutions {
+		start, _ := candleStart(res, ev.Timestamp)
+		if c.candles[res] == nil {
+			c.candles[res] = make(map[int64]*memCandle)
+		}
+		cd := c.candles[res][start]
+		if cd == nil {
+			cd = &memCandle{Candle: Candle{Start: start}}
+			c.candles[res][start] = cd
+		}
+		cd.addTrade(ev.Price, ev.Timestamp, &cd.openTS, &cd.closeTS)
+	}
+	if ev.Sale != nil {
+		c.pushSale(ev.Sale)
+	}
+	return true, old, nil
+}
+
+func (s *MemoryStore) NftOwner(ctx context.Context, collection, address string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.coll(collection).owners[address]
+	return v, ok, nil
+}
+
+// setOwner повторяет setOwnerLua; вызывать под mu
+func (c *memCollection) setOwner(address, owner string) {
+	prev, ok := c.owners[address]
+	if ok && prev == owner {
+		return
+	}
+	if ok {
+		delete(c.holdings[prev], address)
+		if len(c.holdings[prev]) == 0 {
+			delete(c.holdings, prev)
+		}
+	}
+	if owner == "" {
+		delete(c.owners, address)
+		return
+	}
+	c.owners[address] = owner
+	if c.holdings[owner] == nil {
+		c.holdings[owner] = make(map[string]bool)
+	}
+	c.holdings[owner][address] = true
+}
+
+func (s *MemoryStore) OwnerNfts(ctx context.Context, collection, owner string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for addr := range s.coll(collection).holdings[owner] {
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (s *MemoryStore) HolderCount(ctx context.Context, collection string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.coll(collection).holdings)), nil
+}
+
+func (s *MemoryStore) SetNftOwner(ctx context.Context, collection, address, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coll(collection).setOwner(address, owner)
+	return nil
+}
+
+func (s *MemoryStore) ClaimOwnerCheck(ctx context.Context, collection, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.coll(collection)
+	if time.Now().Before(c.checked[owner]) {
+		return false, nil
+	}
+	c.checked[owner] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (s *MemoryStore) NftListing(ctx context.Context, collection, address string) (*Listing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.coll(collection).listings[address]
+	if !ok {
+		return nil, nil
+	}
+	return &l, nil
+}
+
+func (s *MemoryStore) Listings(ctx context.Context, collection string) (map[string]Listing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	listings := make(map[string]Listing, len(s.coll(collection).listings))
+	for addr, l := range s.coll(collection).listings {
+		listings[addr] = l
+	}
+	return listings, nil
+}
+
+func (s *MemoryStore) NftOffers(ctx context.Context, collection, address string) ([]Offer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var offers []Offer
+	for _, o := range s.coll(collection).offers[address] {
+		if !o.Cancelled {
+			offers = append(offers, o)
+		}
+	}
+	sortOffers(offers)
+	return offers, nil
+}
+
+func (s *MemoryStore) Cursor(ctx context.Context, collection string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coll(collection).cursor, nil
+}
+
+func (s *MemoryStore) SetCursor(ctx context.Context, collection, cursor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coll(collection).cursor = cursor
+	return nil
+}
+
+func (s *MemoryStore) LastTS(ctx context.Context, collection string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coll(collection).lastTS, nil
+}
+
+func (s *MemoryStore) SetLastTS(ctx context.Context, collection string, ts int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coll(collection).lastTS = ts
+	return nil
+}
+
+func (s *MemoryStore) Backfill(ctx context.Context, collection string) (BackfillProgress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coll(collection).backfill, nil
+}
+
+func (s *MemoryStore) SetBackfill(ctx context.Context, collection string, p BackfillProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coll(collection).backfill = p
+	return nil
+}
+
+func (s *MemoryStore) Flag(ctx context.Context, collection, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coll(collection).flags[name], nil
+}
+
+func (s *MemoryStore) SetFlag(ctx context.Context, collection, name string, value bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coll(collection).flags[name] = value
+	return nil
+}
+
+func (s *MemoryStore) PushSale(ctx context.Context, collection string, sale []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coll(collection).pushSale(sale)
+	return nil
+}
+
+// pushSale добавляет продажу в очередь, обрезая её до saleStreamMaxLen; вызывать под mu
+func (c *memCollection) pushSale(sale []byte) {
+	c.saleSeq++
+	c.queue = append(c.queue, &SaleMessage{ID: strconv.FormatInt(c.saleSeq, 10), Data: sale})
+	if len(c.queue) > saleStreamMaxLen {
+		c.queue = c.queue[len(c.queue)-saleStreamMaxLen:]
+	}
+}
+
+// ReadSale опрашивает очередь, пока не появится продажа или не пройдёт saleReadBlock
+func (s *MemoryStore) ReadSale(ctx context.Context, collection, consumer string) (*SaleMessage, error) {
+	deadline := time.Now().Add(saleReadBlock)
+	for {
+		if msg := s.nextSale(collection); msg != nil {
+			return msg, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (s *MemoryStore) nextSale(collection string) *SaleMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.coll(collection)
+	now := time.Now()
+
+	for _, f := range c.inflight {
+		if now.Sub(f.at) >= saleClaimIdle {
+			f.at = now
+			f.msg.Deliveries++
+			msg := *f.msg
+			return &msg
+		}
+	}
+	if len(c.queue) == 0 {
+		return nil
+	}
+	msg := c.queue[0]
+	c.queue = c.queue[1:]
+	msg.Deliveries = 1
+	c.inflight[msg.ID] = &memInflight{msg: msg, at: now}
+	out := *msg
+	return &out
+}
+
+func (s *MemoryStore) AckSale(ctx context.Context, collection, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.coll(collection).inflight, id)
+	return nil
+}
+
+func (s *MemoryStore) CachedPrice(ctx context.Context, key string) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.cache[key]
+	if !ok || (!v.expires.IsZero() && time.Now().After(v.expires)) {
+		return 0, false, nil
+	}
+	return v.value, true, nil
+}
+
+func (s *MemoryStore) CachePrice(ctx context.Context, key string, value float64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cached := memCached{value: value}
+	if ttl > 0 {
+		cached.expires = time.Now().Add(ttl)
+	}
+	s.cache[key] = cached
+	s.last[key] = value
+	return nil
+}
+
+func (s *MemoryStore) LastPrice(ctx context.Context, key string) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.last[key]
+	return v, ok, nil
+}
+
+func (s *MemoryStore) AddFloorSample(ctx context.Context, product string, sample FloorSample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := sample.TS - floorSampleRetention.Milliseconds()
+	var samples []FloorSample
+	for _, old := range s.floor[product] {
+		if old.TS != sample.TS && old.TS >= cutoff {
+			samples = append(samples, old)
+		}
+	}
+	samples = append(samples, sample)
+	sort.Slice(samples, func(i, j int) bool { return samples[i].TS < samples[j].TS })
+	s.floor[product] = samples
+	return nil
+}
+
+func (s *MemoryStore) FloorSampleAt(ctx context.Context, product string, ts int64) (*FloorSample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := s.floor[product]
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].TS > ts })
+	if i == 0 {
+		return nil, nil
+	}
+	sample := samples[i-1]
+	return &sample, nil
+}
+
+func (s *MemoryStore) Status(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status[name], nil
+}
+
+func (s *MemoryStore) SetStatus(ctx context.Context, name, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[name] = status
+	return nil
+}
@@ -0,0 +1,97 @@
+package botutils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Разрешения свечей продаж
+const (
+	Resolution1h = "1h"
+	Resolution1d = "1d"
+	Resolution1w = "1w"
+)
+
+// candleResolutions — разрешения, которые ведёт индексатор
+var candleResolutions = []string{Resolution1h, Resolution1d, Resolution1w}
+
+// Candle — продажи коллекции за один интервал: цены открытия, максимума,
+// минимума и закрытия, объём в TON и число сделок
+type Candle struct {
+	Start  int64 // начало интервала, мс
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+	Trades int64
+}
+
+// candleStart — начало интервала разрешения res, в который попадает ts (мс, UTC).
+// Неделя начинается в понедельник, как ISO-неделя счётчиков продаж.
+func candleStart(res string, ts int64) (int64, error) {
+	t := time.UnixMilli(ts).UTC()
+	switch res {
+	case Resolution1h:
+		return t.Truncate(time.Hour).UnixMilli(), nil
+	case Resolution1d:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).UnixMilli(), nil
+	case Resolution1w:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)).UnixMilli(), nil
+	}
+	return 0, fmt.Errorf("неизвестное разрешение %q", res)
+}
+
+// addTrade добавляет сделку в свечу; at — время сделки, openTS/closeTS — время
+// сделок, давших цены открытия и закрытия (события приходят не по порядку)
+func (c *Candle) addTrade(price float64, at int64, openTS, closeTS *int64) {
+	if c.Trades == 0 || at < *openTS {
+		c.Open, *openTS = price, at
+	}
+	if c.Trades == 0 || at >= *closeTS {
+		c.Close, *closeTS = price, at
+	}
+	if c.Trades == 0 || price > c.High {
+		c.High = price
+	}
+	if c.Trades == 0 || price < c.Low {
+		c.Low = price
+	}
+	c.Volume += price
+	c.Trades++
+}
+
+// candleLua — функция Lua, добавляющая сделку в свечу-хэш и её начало в индекс свечей.
+// Поля: o/h/l/c — цены, ots/cts — время сделок открытия и закрытия, v — объём, n — сделки.
+const candleLua = `
+local function addCandle(key, index, start, ts, price)
+	local c = redis.call('HMGET', key, 'h', 'l', 'ots', 'cts')
+	local p = tonumber(price)
+	if not c[3] or ts < tonumber(c[3]) then
+		redis.call('HSET', key, 'o', price, 'ots', ts)
+	end
+	if not c[4] or ts >= tonumber(c[4]) then
+		redis.call('HSET', key, 'c', price, 'cts', ts)
+	end
+	if not c[1] or p > tonumber(c[1]) then
+		redis.call('HSET', key, 'h', price)
+	end
+	if not c[2] or p < tonumber(c[2]) then
+		redis.call('HSET', key, 'l', price)
+	end
+	redis.call('HINCRBYFLOAT', key, 'v', price)
+	redis.call('HINCRBY', key, 'n', 1)
+	redis.call('ZADD', index, start, start)
+end
+`
+
+// GetOHLC — свечи продаж коллекции разрешения res, начавшиеся в [from, to), по времени.
+// Интервалы без продаж пропускаются. Продажи, проиндексированные до появления
+// свечей, в них есть только после пересборки индекса (rebuild).
+func GetOHLC(st Store, collection, res string, from, to time.Time) ([]Candle, error) {
+	if _, err := candleStart(res, 0); err != nil {
+		return nil, err
+	}
+	return st.Candles(Ctx, collection, res, from.UnixMilli(), to.UnixMilli())
+}
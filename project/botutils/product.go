@@ -0,0 +1,182 @@
+package botutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TraitFilter — трейт основной коллекции, по которому считается флор (например, Reactor).
+// Пустое Name означает «любой трейт с таким значением».
+type TraitFilter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Product описывает отслеживаемый «продукт»: основную коллекцию
+// и коллекцию её фрагментов, которую индексирует бот
+type Product struct {
+	ID                 string      `json:"id"`                 // короткое имя для ключей кэша и команд
+	Name               string      `json:"name"`               // как показывать основную коллекцию
+	FragmentName       string      `json:"fragmentName"`       // как показывать фрагменты
+	Collection         string      `json:"collection"`         // адрес основной коллекции
+	FragmentCollection string      `json:"fragmentCollection"` // адрес коллекции фрагментов (индексируется)
+	FloorTrait         TraitFilter `json:"floorTrait"`
+	MintPrice          float64     `json:"mintPrice"`        // цена минта фрагмента в TON
+	MintTonUSD         float64     `json:"mintTonUsd"`       // курс TON на момент минта
+	FragmentsPerItem   float64     `json:"fragmentsPerItem"` // сколько фрагментов в одной основной NFT
+	AddressesFile      string      `json:"addressesFile"`    // снимок адресов фрагментов для сверки индекса
+}
+
+// defaultProducts — конфигурация по умолчанию, если PRODUCTS_FILE не задан
+var defaultProducts = []*Product{
+	{
+		ID:                 "heart-locket",
+		Name:               "Heart Locket",
+		FragmentName:       "фрагменты",
+		Collection:         "EQC4XEulxb05Le5gF6esMtDWT5XZ6tlzlMBQGNsqffxpdC5U",
+		FragmentCollection: "EQAnmo8tBH8gSErzWDrdlJiF8kxgfJEynKMIBxL2MkuHvPBc",
+		FloorTrait:         TraitFilter{Value: "Reactor"},
+		MintPrice:          1.4,
+		MintTonUSD:         3.125,
+		FragmentsPerItem:   1000,
+		AddressesFile:      "nft_addresses.txt",
+	},
+}
+
+var (
+	productsMu sync.RWMutex
+	products   = defaultProducts
+)
+
+// LoadProducts читает список продуктов из JSON-файла (массив Product).
+// Пустой path оставляет конфигурацию по умолчанию.
+// Без файла COLLECTION_ADDRESS, если задан, заменяет коллекцию фрагментов продукта по умолчанию.
+func LoadProducts(path string) error {
+	if path == "" {
+		if addr := os.Getenv("COLLECTION_ADDRESS"); addr != "" {
+			productsMu.Lock()
+			products[0].FragmentCollection = addr
+			productsMu.Unlock()
+		}
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var loaded []*Product
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(loaded) == 0 {
+		return fmt.Errorf("%s: список продуктов пуст", path)
+	}
+	for i, p := range loaded {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("%s: продукт #%d: %w", path, i, err)
+		}
+	}
+
+	productsMu.Lock()
+	products = loaded
+	productsMu.Unlock()
+	return nil
+}
+
+func (p *Product) validate() error {
+	switch {
+	case p.ID == "":
+		return fmt.Errorf("не задан id")
+	case p.Collection == "":
+		return fmt.Errorf("%s: не задан collection", p.ID)
+	case p.FragmentCollection == "":
+		return fmt.Errorf("%s: не задан fragmentCollection", p.ID)
+	case p.MintPrice <= 0:
+		return fmt.Errorf("%s: mintPrice должен быть больше 0", p.ID)
+	}
+	if p.FragmentsPerItem <= 0 {
+		p.FragmentsPerItem = 1
+	}
+	if p.Name == "" {
+		p.Name = p.ID
+	}
+	return nil
+}
+
+// Products возвращает все отслеживаемые продукты
+func Products() []*Product {
+	productsMu.RLock()
+	defer productsMu.RUnlock()
+	return products
+}
+
+// DefaultProduct — первый продукт из конфигурации
+func DefaultProduct() *Product {
+	return Products()[0]
+}
+
+// ProductByCollection ищет продукт по адресу коллекции фрагментов
+func ProductByCollection(collection string) (*Product, bool) {
+	for _, p := range Products() {
+		if p.FragmentCollection == collection {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// ProductBySelector ищет продукт по id, имени или адресу любой из его коллекций.
+// Пустой селектор — продукт по умолчанию.
+func ProductBySelector(selector string) (*Product, bool) {
+	if selector == "" {
+		return DefaultProduct(), true
+	}
+	for _, p := range Products() {
+		if strings.EqualFold(p.ID, selector) || strings.EqualFold(p.Name, selector) ||
+			p.Collection == selector || p.FragmentCollection == selector {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// productIDs — список id для подсказок в командах
+func productIDs() string {
+	ids := make([]string, 0, len(Products()))
+	for _, p := range Products() {
+		ids = append(ids, p.ID)
+	}
+	return strings.Join(ids, ", ")
+}
+
+// cacheKey — ключ кэша цены, свой для каждого продукта
+func (p *Product) cacheKey(name string) string {
+	return name + ":" + p.ID
+}
+
+// FragmentFloor пересчитывает флор основной коллекции в цену одного фрагмента
+func (p *Product) FragmentFloor(itemFloor float64) float64 {
+	return itemFloor / p.FragmentsPerItem
+}
+
+// MintPriceUSD — цена минта фрагмента в долларах
+func (p *Product) MintPriceUSD() float64 {
+	return p.MintPrice * p.MintTonUSD
+}
+
+// mintPriceFor возвращает цену минта для индексируемой коллекции
+func mintPriceFor(collection string) float64 {
+	if p, ok := ProductByCollection(collection); ok {
+		return p.MintPrice
+	}
+	return defaultPrice
+}
+
+// matches проверяет, подходит ли трейт под фильтр
+func (f TraitFilter) matches(traitType, value string) bool {
+	return value == f.Value && (f.Name == "" || f.Name == traitType)
+}
@@ -0,0 +1,289 @@
+package botutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/getgems"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rebuildPrefix — пространство ключей, в которое пересобирается индекс до подмены
+const rebuildPrefix = "rebuild:"
+
+// rebuildTolerance — на какую долю пересобранное число NFT может отличаться
+// от живого индекса и от числа NFT коллекции по API
+const rebuildTolerance = 0.02
+
+// RebuildReport — итог пересборки индекса коллекции
+type RebuildReport struct {
+	Collection string
+	NFTs       int64   // NFT с известной ценой после пересборки
+	Sum        float64 // сумма последних цен после пересборки
+	OldNFTs    int64   // значения живого индекса до подмены
+	OldSum     float64
+	APIItems   int // NFT в коллекции по API; 0 — не удалось узнать
+	Swapped    int // сколько ключей подменено
+}
+
+func (r RebuildReport) String() string {
+	return fmt.Sprintf("%s: NFT %d → %d (по API %d), сумма %.4f → %.4f, подменено ключей: %d",
+		r.Collection, r.OldNFTs, r.NFTs, r.APIItems, r.OldSum, r.Sum, r.Swapped)
+}
+
+// RebuildCollectionIndex заново проигрывает всю историю коллекции в отдельное
+// пространство ключей, проверяет результат и атомарно подменяет им живой индекс.
+// До подмены бот продолжает работать со старыми данными. force — подменить, даже если
+// число NFT расходится с живым индексом или API (например, живой индекс и есть сломанный).
+func RebuildCollectionIndex(ctx context.Context, rds *redis.Client, collection string, force bool) (*RebuildReport, error) {
+	live := NewRedisStore(rds)
+	processName := "collection_rebuild:" + collection
+	live.SetStatus(ctx, processName, "running")
+	status := "error"
+	defer func() { live.SetStatus(Ctx, processName, status) }()
+
+	st := &RedisStore{rds: rds, prefix: rebuildPrefix}
+	k := st.keys(collection)
+
+	// остатки прошлой неудачной пересборки
+	if err := deleteIndexKeys(ctx, rds, k); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Rebuild] %s: проигрываем историю с начала", collection)
+	if _, _, err := replayHistory(ctx, st, collection, apiqueue.Backfill, false, nil); err != nil {
+		return nil, fmt.Errorf("проигрывание истории: %w", err)
+	}
+
+	// живой индексатор не должен писать, пока догоняем хвост и подменяем ключи
+	lock, err := AcquireIndexLock(ctx, rds, collection, "rebuild@"+InstanceName())
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+	ctx = lock.Context()
+
+	log.Printf("[Rebuild] %s: догоняем события, пришедшие за время пересборки", collection)
+	if _, _, err := replayHistory(ctx, st, collection, apiqueue.Indexer, false, nil); err != nil {
+		return nil, fmt.Errorf("догон истории: %w", err)
+	}
+
+	report := &RebuildReport{Collection: collection}
+	if err := verifyIndex(ctx, st, live, collection, report, force); err != nil {
+		return nil, fmt.Errorf("проверка пересборки: %w", err)
+	}
+
+	if report.Swapped, err = swapIndex(ctx, rds, k); err != nil {
+		return nil, fmt.Errorf("подмена индекса: %w", err)
+	}
+	// индекс собран текущим кодом — пересборка, назначенная миграцией, больше не нужна
+	if err := live.SetFlag(ctx, collection, flagReindex, false); err != nil {
+		return nil, err
+	}
+
+	status = "idle"
+	log.Printf("[Rebuild] готово: %s", report)
+	return report, nil
+}
+
+// reindexRetry — пауза перед повтором неудавшейся пересборки, назначенной миграцией
+const reindexRetry = time.Hour
+
+// reindexLockKey — блокировка пересборки коллекции, назначенной миграцией:
+// её выполняет одна реплика
+func reindexLockKey(collection string) string {
+	return "lock:collection_reindex:" + collection
+}
+
+// ReindexWhenRequested в фоне выполняет пересборку, назначенную миграцией (флаг reindex);
+// бот тем временем отвечает по старому индексу. Неудавшаяся попытка повторяется через
+// reindexRetry; rebuild -force или wipe снимают назначение.
+func ReindexWhenRequested(rds *redis.Client, collection string) {
+	for {
+		err := reindexIfRequested(Ctx, rds, collection)
+		if err == nil {
+			return
+		}
+		log.Printf("[Rebuild] %s: пересборка после миграции не удалась, повтор через %s: %v", collection, reindexRetry, err)
+		time.Sleep(reindexRetry)
+	}
+}
+
+// reindexIfRequested выполняет назначенную пересборку, если её не взяла другая реплика.
+// Собранный индекс пересобирается и подменяется; незавершённый первичный проход ещё
+// ничего не показывает — его индекс сбрасывается, и индексатор начнёт заново.
+func reindexIfRequested(ctx context.Context, rds *redis.Client, collection string) error {
+	live := NewRedisStore(rds)
+	if requested, err := live.Flag(ctx, collection, flagReindex); err != nil || !requested {
+		return err
+	}
+
+	lock, err := tryLock(ctx, rds, reindexLockKey(collection), "reindex@"+InstanceName())
+	if err != nil || lock == nil {
+		return err
+	}
+	defer lock.Release()
+	ctx = lock.Context()
+
+	// между проверкой и блокировкой пересборку могла закончить другая реплика
+	requested, err := live.Flag(ctx, collection, flagReindex)
+	if err != nil || !requested {
+		return err
+	}
+	indexed, err := live.Flag(ctx, collection, flagIndexed)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		_, err := RebuildCollectionIndex(ctx, rds, collection, false)
+		return err
+	}
+
+	log.Printf("[Rebuild] %s: первичный проход не завершён, начинаем его заново", collection)
+	indexLock, err := AcquireIndexLock(ctx, rds, collection, "reindex@"+InstanceName())
+	if err != nil {
+		return err
+	}
+	defer indexLock.Release()
+	ctx = indexLock.Context()
+
+	k := liveKeys(collection)
+	if err := deleteIndexKeys(ctx, rds, k); err != nil {
+		return err
+	}
+	if err := rds.Del(ctx, k.flag(flagPrimaryDone)).Err(); err != nil {
+		return err
+	}
+	return live.SetFlag(ctx, collection, flagReindex, false)
+}
+
+// verifyIndex проверяет пересобранный индекс st перед подменой. Агрегаты должны
+// сходиться с ценами NFT, а число NFT — с источниками, которые эта пересборка не писала:
+// живым индексом live (заметно меньше него — признак оборванной истории) и числом
+// NFT коллекции по API. Итог записывается в report.
+func verifyIndex(ctx context.Context, st, live Store, collection string, report *RebuildReport, force bool) error {
+	check, _, err := recountIndex(ctx, st, collection)
+	if err != nil {
+		return err
+	}
+	if check.Count == 0 {
+		return fmt.Errorf("в истории нет ни одной NFT")
+	}
+	if check.Drift() {
+		return fmt.Errorf("агрегаты не сходятся: %s", check)
+	}
+	report.NFTs, report.Sum = check.Count, check.Sum
+
+	old, _, err := recountIndex(ctx, live, collection)
+	if err != nil {
+		return err
+	}
+	report.OldNFTs, report.OldSum = old.Count, old.Sum
+
+	statsCtx, cancel := context.WithTimeout(getgems.WithPriority(ctx, apiqueue.Indexer), apiTimeout)
+	defer cancel()
+	if stats, err := gg().CollectionStats(statsCtx, collection); err != nil {
+		log.Printf("[Rebuild] %s: число NFT по API не получено, сверяем только с живым индексом: %v", collection, err)
+	} else {
+		report.APIItems = stats.ItemsCount
+	}
+
+	if force {
+		return nil
+	}
+	if float64(report.NFTs) < float64(report.OldNFTs)*(1-rebuildTolerance) {
+		return fmt.Errorf("NFT меньше, чем в живом индексе: %d < %d (подменить всё равно — -force)",
+			report.NFTs, report.OldNFTs)
+	}
+	if report.APIItems > 0 && math.Abs(float64(report.NFTs-int64(report.APIItems))) > float64(report.APIItems)*rebuildTolerance {
+		return fmt.Errorf("NFT %d, а по API %d (подменить всё равно — -force)", report.NFTs, report.APIItems)
+	}
+	return nil
+}
+
+// indexKeyPatterns — все ключи индекса коллекции в пространстве k
+func indexKeyPatterns(k indexKeys) []string {
+	return []string{
+		k.nftPrice("*"),
+		k.prices(),
+		k.candle("*", "*"),
+		k.candleIndex("*"),
+		k.nftOwner("*"),
+		k.nftEventTS("*"),
+		k.nftPriceTS("*"),
+		k.nftOffers("*"),
+		k.backfill(),
+		k.ownerNfts("*"),
+		k.holders(),
+		k.listings(),
+		k.sales("*", "*"),
+		k.sum(),
+		k.count(),
+		k.applied(),
+		k.cursor(),
+		k.lastTS(),
+	}
+}
+
+// swapIndex одной транзакцией удаляет живой индекс коллекции и переименовывает на его место пересобранный
+func swapIndex(ctx context.Context, rds *redis.Client, k indexKeys) (int, error) {
+	var oldKeys, newKeys []string
+	for _, pattern := range indexKeyPatterns(liveKeys(k.collection)) {
+		keys, err := scanKeys(ctx, rds, pattern)
+		if err != nil {
+			return 0, err
+		}
+		oldKeys = append(oldKeys, keys...)
+	}
+	for _, pattern := range indexKeyPatterns(k) {
+		keys, err := scanKeys(ctx, rds, pattern)
+		if err != nil {
+			return 0, err
+		}
+		newKeys = append(newKeys, keys...)
+	}
+
+	pipe := rds.TxPipeline()
+	if len(oldKeys) > 0 {
+		pipe.Del(ctx, oldKeys...)
+	}
+	for _, key := range newKeys {
+		pipe.Rename(ctx, key, strings.TrimPrefix(key, k.prefix))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return len(newKeys), nil
+}
+
+// deleteIndexKeys удаляет все ключи индекса коллекции в пространстве k
+func deleteIndexKeys(ctx context.Context, rds *redis.Client, k indexKeys) error {
+	for _, pattern := range indexKeyPatterns(k) {
+		keys, err := scanKeys(ctx, rds, pattern)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := rds.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanKeys собирает ключи по шаблону через SCAN, не блокируя Redis как KEYS
+func scanKeys(ctx context.Context, rds *redis.Client, pattern string) ([]string, error) {
+	var keys []string
+	iter := rds.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
@@ -0,0 +1,746 @@
+package botutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore — Store поверх Redis. prefix отделяет пространство ключей:
+// живые данные лежат без префикса, пересборка индекса — под rebuildPrefix.
+type RedisStore struct {
+	rds    *redis.Client
+	prefix string
+}
+
+// NewRedisStore — хранилище с живыми ключами бота
+func NewRedisStore(rds *redis.Client) *RedisStore {
+	return &RedisStore{rds: rds}
+}
+
+func (s *RedisStore) keys(collection string) indexKeys {
+	return indexKeys{prefix: s.prefix, collection: collection}
+}
+
+// setOwnerLua — функция Lua, меняющая владельца NFT вместе с множествами NFT
+// владельцев и счётчиком их NFT; пустой owner — владелец неизвестен (burn, сверка).
+// Держатель без NFT удаляется из счётчика, так что HLEN — число держателей.
+const setOwnerLua = `
+local function setOwner(ownerKey, holdersKey, setPrefix, addr, owner)
+	local prev = redis.call('GET', ownerKey)
+	if prev == owner then
+		return
+	end
+	if prev then
+		redis.call('SREM', setPrefix .. prev, addr)
+		if redis.call('HINCRBY', holdersKey, prev, -1) <= 0 then
+			redis.call('HDEL', holdersKey, prev)
+		end
+	end
+	if owner == '' then
+		redis.call('DEL', ownerKey)
+		return
+	end
+	redis.call('SET', ownerKey, owner)
+	redis.call('SADD', setPrefix .. owner, addr)
+	redis.call('HINCRBY', holdersKey, owner, 1)
+end
+`
+
+// setOwnerScript — setOwner отдельно от события, для сверки с API.
+// KEYS: 1 — владелец NFT, 2 — число NFT у владельцев; ARGV: 1 — префикс множеств,
+// 2 — адрес NFT, 3 — владелец.
+var setOwnerScript = redis.NewScript(setOwnerLua + `
+setOwner(KEYS[1], KEYS[2], ARGV[1], ARGV[2], ARGV[3])
+return 1
+`)
+
+// applyEventScript применяет одно событие истории целиком на стороне Redis,
+// чтобы падение между шагами не оставляло цену NFT, сумму, количество,
+// счётчики продаж, владельца и выставление рассинхронизированными.
+//
+// KEYS: 1 — цена NFT, 2 — сумма, 3 — количество, 4/5/6 — продажи за день/неделю/месяц,
+// 7 — поток продаж, 8 — применённые события, 9 — курсор, 10 — владелец NFT,
+// 11 — выставления коллекции, 12 — число NFT у каждого владельца,
+// 13 — счётчик токенов блокировки индексатора, 14 — время последнего события NFT,
+// 15 — цены NFT коллекции по возрастанию (ZSET, для медианы и перцентилей),
+// 16/17/18 — свечи продаж 1h/1d/1w, 19/20/21 — их индексы,
+// 22 — время последнего события NFT с ценой (минт или продажа), 23 — предложения на NFT.
+// ARGV: 1 — id события, 2 — тип, 3 — цена (пусто — событие не меняет цену),
+// 4 — JSON продажи для потока (пусто — не публиковать), 5 — курсор, с которого
+// продолжить после этого события, 6 — примерная максимальная длина потока,
+// 7 — новый владелец (пусто — не менять), 8 — JSON нового выставления,
+// 9 — адрес NFT, 10 — 1, если снять выставление, 11 — префикс множеств NFT владельцев,
+// 12 — токен ограждения писателя (0 — без проверки), 13 — время события, мс,
+// 14/15/16 — начало свечей 1h/1d/1w, 17 — покупатель, 18 — JSON его предложения или отзыва.
+// События приходят не по порядку, пока первичный проход истории идёт параллельно
+// с новыми: событие старше уже применённого к NFT не меняет её владельца и выставление,
+// а минт или продажа старше уже учтённой цены не меняют цену, но продажа
+// учитывается в счётчиках и свечах. Время цены ведётся отдельно: более новая
+// передача или выставление не делают устаревшей старую продажу. Предложения
+// сравниваются по времени каждого покупателя: отзыв хранится, пока не придёт более новое.
+// Если с тех пор блокировку взял кто-то ещё (выдан больший токен), возвращает ошибку FENCED.
+// Возвращает {1, старая цена}, если событие применено, {0, ""} — если уже было учтено.
+var applyEventScript = redis.NewScript(setOwnerLua + candleLua + `
+if ARGV[12] ~= '0' and (tonumber(redis.call('GET', KEYS[13]) or '0') or 0) > tonumber(ARGV[12]) then
+	return redis.error_reply('FENCED')
+end
+if ARGV[5] ~= '' then
+	redis.call('SET', KEYS[9], ARGV[5])
+end
+if redis.call('SADD', KEYS[8], ARGV[1]) == 0 then
+	return {0, ''}
+end
+if ARGV[18] ~= '' then
+	local prev = redis.call('HGET', KEYS[23], ARGV[17])
+	if not prev or (tonumber(cjson.decode(prev).since) or 0) <= tonumber(ARGV[13]) then
+		redis.call('HSET', KEYS[23], ARGV[17], ARGV[18])
+	end
+end
+
+local stale = tonumber(ARGV[13]) < (tonumber(redis.call('GET', KEYS[14]) or '0') or 0)
+if not stale then
+	redis.call('SET', KEYS[14], ARGV[13])
+	if ARGV[7] ~= '' then
+		setOwner(KEYS[10], KEYS[12], ARGV[11], ARGV[9], ARGV[7])
+	elseif ARGV[2] == 'burn' then
+		setOwner(KEYS[10], KEYS[12], ARGV[11], ARGV[9], '')
+		redis.call('DEL', KEYS[23])
+	end
+	if ARGV[8] ~= '' then
+		redis.call('HSET', KEYS[11], ARGV[9], ARGV[8])
+	elseif ARGV[10] == '1' then
+		redis.call('HDEL', KEYS[11], ARGV[9])
+	end
+end
+
+if ARGV[3] == '' then
+	return {1, ''}
+end
+local price = tonumber(ARGV[3])
+local priceStale = tonumber(ARGV[13]) < (tonumber(redis.call('GET', KEYS[22]) or '0') or 0)
+if ARGV[2] == 'mint' then
+	if not priceStale and redis.call('SETNX', KEYS[1], ARGV[3]) == 1 then
+		redis.call('SET', KEYS[22], ARGV[13])
+		redis.call('ZADD', KEYS[15], ARGV[3], ARGV[9])
+		redis.call('INCRBYFLOAT', KEYS[2], ARGV[3])
+		redis.call('INCR', KEYS[3])
+	end
+	return {1, ''}
+end
+
+local old = tonumber(redis.call('GET', KEYS[1]) or '0') or 0
+if not priceStale then
+	redis.call('SET', KEYS[22], ARGV[13])
+end
+if old ~= price and not priceStale then
+	redis.call('SET', KEYS[1], ARGV[3])
+	redis.call('ZADD', KEYS[15], ARGV[3], ARGV[9])
+	if old == 0 then
+		redis.call('INCR', KEYS[3])
+		redis.call('INCRBYFLOAT', KEYS[2], ARGV[3])
+	else
+		redis.call('INCRBYFLOAT', KEYS[2], tostring(price - old))
+	end
+end
+redis.call('INCR', KEYS[4])
+redis.call('INCR', KEYS[5])
+redis.call('INCR', KEYS[6])
+local ts = tonumber(ARGV[13])
+for i = 0, 2 do
+	addCandle(KEYS[16 + i], KEYS[19 + i], ARGV[14 + i], ts, ARGV[3])
+end
+if ARGV[4] ~= '' then
+	redis.call('XADD', KEYS[7], 'MAXLEN', '~', ARGV[6], '*', 'sale', ARGV[4])
+end
+return {1, tostring(old)}
+`)
+
+// fencedSetScript записывает состояние индексатора, если писатель всё ещё держит блокировку.
+// KEYS: 1 — ключ, 2 — счётчик токенов блокировки; ARGV: 1 — значение, 2 — токен (0 — без проверки).
+// Если блокировку с тех пор взял кто-то ещё, возвращает ошибку FENCED.
+var fencedSetScript = redis.NewScript(`
+if ARGV[2] ~= '0' and (tonumber(redis.call('GET', KEYS[2]) or '0') or 0) > tonumber(ARGV[2]) then
+	return redis.error_reply('FENCED')
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1
+`)
+
+// fencedSet пишет курсор, флаг или прогресс индексатора с проверкой токена из ctx
+func (s *RedisStore) fencedSet(ctx context.Context, collection, key string, value interface{}) error {
+	err := fencedSetScript.Run(ctx, s.rds, []string{key, indexFenceKey(collection)}, value, fenceFrom(ctx, collection)).Err()
+	if err != nil && strings.HasPrefix(err.Error(), "FENCED") {
+		return ErrLockLost
+	}
+	return err
+}
+
+// indexKeys — ключи индекса одной коллекции. Живой индекс лежит без префикса,
+// пересборка пишет в отдельное пространство с префиксом до подмены.
+type indexKeys struct {
+	prefix     string
+	collection string
+}
+
+// liveKeys — ключи индекса, с которыми работает бот
+func liveKeys(collection string) indexKeys {
+	return indexKeys{collection: collection}
+}
+
+func (k indexKeys) nftPrice(addr string) string {
+	return k.prefix + "nft:last_price:" + k.collection + ":" + addr
+}
+func (k indexKeys) nftOwner(addr string) string {
+	return k.prefix + "nft:owner:" + k.collection + ":" + addr
+}
+func (k indexKeys) nftEventTS(addr string) string {
+	return k.prefix + "nft:event_ts:" + k.collection + ":" + addr
+}
+func (k indexKeys) nftPriceTS(addr string) string {
+	return k.prefix + "nft:price_ts:" + k.collection + ":" + addr
+}
+func (k indexKeys) nftOffers(addr string) string {
+	return k.prefix + "nft:offers:" + k.collection + ":" + addr
+}
+func (k indexKeys) prices() string { return k.prefix + "collection:prices:" + k.collection }
+func (k indexKeys) candle(res, start string) string {
+	return k.prefix + "collection:ohlc:" + k.collection + ":" + res + ":" + start
+}
+func (k indexKeys) candleIndex(res string) string {
+	return k.prefix + "collection:ohlc_index:" + k.collection + ":" + res
+}
+func (k indexKeys) backfill() string { return k.prefix + "collection:backfill:" + k.collection }
+func (k indexKeys) ownerNfts(owner string) string {
+	return k.prefix + "owner:nfts:" + k.collection + ":" + owner
+}
+func (k indexKeys) holders() string { return k.prefix + "collection:holders:" + k.collection }
+func (k indexKeys) ownerChecked(owner string) string {
+	return k.prefix + "owner:checked:" + k.collection + ":" + owner
+}
+func (k indexKeys) listings() string   { return k.prefix + "collection:listings:" + k.collection }
+func (k indexKeys) sum() string        { return k.prefix + "collection:sum:" + k.collection }
+func (k indexKeys) count() string      { return k.prefix + "collection:count:" + k.collection }
+func (k indexKeys) saleStream() string { return k.prefix + saleStreamKey(k.collection) }
+func (k indexKeys) applied() string    { return k.prefix + appliedEventsKey(k.collection) }
+func (k indexKeys) cursor() string     { return k.prefix + "collection:cursor:" + k.collection }
+func (k indexKeys) lastTS() string     { return k.prefix + "collection:last_ts:" + k.collection }
+func (k indexKeys) sales(period, bucket string) string {
+	return k.prefix + salesKey(k.collection, period, bucket)
+}
+func (k indexKeys) flag(name string) string {
+	return k.prefix + "collection:" + k.collection + ":" + name
+}
+
+func (s *RedisStore) NftPrice(ctx context.Context, collection, address string) (float64, bool, error) {
+	v, err := s.rds.Get(ctx, s.keys(collection).nftPrice(address)).Float64()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// NftPrices собирает ключи через SCAN и читает цены пачками MGET
+func (s *RedisStore) NftPrices(ctx context.Context, collection string) (map[string]float64, error) {
+	k := s.keys(collection)
+	keys, err := scanKeys(ctx, s.rds, k.nftPrice("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	const batch = 500
+	prefix := k.nftPrice("")
+	prices := make(map[string]float64, len(keys))
+	for start := 0; start < len(keys); start += batch {
+		end := start + batch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		values, err := s.rds.MGet(ctx, keys[start:end]...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			str, ok := v.(string)
+			if !ok {
+				continue // ключ удалили между SCAN и MGET
+			}
+			price, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", keys[start+i], err)
+			}
+			prices[strings.TrimPrefix(keys[start+i], prefix)] = price
+		}
+	}
+	return prices, nil
+}
+
+func (s *RedisStore) PriceRange(ctx context.Context, collection string, start, stop int64) ([]float64, error) {
+	zs, err := s.rds.ZRangeWithScores(ctx, s.keys(collection).prices(), start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	prices := make([]float64, len(zs))
+	for i, z := range zs {
+		prices[i] = z.Score
+	}
+	return prices, nil
+}
+
+func (s *RedisStore) PriceCountBetween(ctx context.Context, collection string, min, max float64) (int64, error) {
+	return s.rds.ZCount(ctx, s.keys(collection).prices(), zScore(min), "("+zScore(max)).Result()
+}
+
+// zScore — граница диапазона ZCOUNT; бесконечности Redis пишет как -inf/+inf
+func zScore(v float64) string {
+	switch {
+	case math.IsInf(v, -1):
+		return "-inf"
+	case math.IsInf(v, 1):
+		return "+inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Candles находит начала свечей в индексе и читает их хэши одним конвейером
+func (s *RedisStore) Candles(ctx context.Context, collection, res string, from, to int64) ([]Candle, error) {
+	k := s.keys(collection)
+	starts, err := s.rds.ZRangeByScore(ctx, k.candleIndex(res), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from, 10),
+		Max: "(" + strconv.FormatInt(to, 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.rds.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(starts))
+	for i, start := range starts {
+		cmds[i] = pipe.HMGet(ctx, k.candle(res, start), "o", "h", "l", "c", "v", "n")
+	}
+	if len(starts) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	candles := make([]Candle, 0, len(starts))
+	for i, start := range starts {
+		var f [6]float64
+		for j, v := range cmds[i].Val() {
+			str, _ := v.(string)
+			f[j], _ = strconv.ParseFloat(str, 64)
+		}
+		c := Candle{Open: f[0], High: f[1], Low: f[2], Close: f[3], Volume: f[4], Trades: int64(f[5])}
+		c.Start, _ = strconv.ParseInt(start, 10, 64)
+		candles = append(candles, c)
+	}
+	return candles, nil
+}
+
+func (s *RedisStore) Aggregate(ctx context.Context, collection string) (float64, int64, error) {
+	k := s.keys(collection)
+	sum, err := getFloat64(ctx, s.rds, k.sum())
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := getInt64(ctx, s.rds, k.count())
+	if err != nil {
+		return 0, 0, err
+	}
+	return sum, count, nil
+}
+
+func (s *RedisStore) SetAggregate(ctx context.Context, collection string, sum float64, count int64) error {
+	k := s.keys(collection)
+	pipe := s.rds.TxPipeline()
+	pipe.Set(ctx, k.sum(), sum, 0)
+	pipe.Set(ctx, k.count(), count, 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) SalesCount(ctx context.Context, collection, period, bucket string) (int64, error) {
+	return getInt64(ctx, s.rds, s.keys(collection).sales(period, bucket))
+}
+
+// ApplyEvent выполняет applyEventScript: всё событие — одна операция Redis
+func (s *RedisStore) ApplyEvent(ctx context.Context, collection string, ev IndexEvent) (applied bool, oldPrice float64, err error) {
+	k := s.keys(collection)
+	ts := ev.Timestamp
+	keys := []string{
+		k.nftPrice(ev.Address),
+		k.sum(),
+		k.count(),
+		k.sales("day", dayKey(ts)),
+		k.sales("week", weekKey(ts)),
+		k.sales("month", monthKey(ts)),
+		k.saleStream(),
+		k.applied(),
+		k.cursor(),
+		k.nftOwner(ev.Address),
+		k.listings(),
+		k.holders(),
+		indexFenceKey(collection),
+		k.nftEventTS(ev.Address),
+		k.prices(),
+	}
+	var starts []interface{}
+	for _, res := range candleResolutions {
+		start, _ := candleStart(res, ts)
+		keys = append(keys, k.candle(res, strconv.FormatInt(start, 10)))
+		starts = append(starts, start)
+	}
+	for _, res := range candleResolutions {
+		keys = append(keys, k.candleIndex(res))
+	}
+	keys = append(keys, k.nftPriceTS(ev.Address), k.nftOffers(ev.Address))
+	var price string
+	if ev.HasPrice {
+		price = strconv.FormatFloat(ev.Price, 'f', -1, 64)
+	}
+	var listing []byte
+	if ev.Listing != nil {
+		if listing, err = json.Marshal(ev.Listing); err != nil {
+			return false, 0, err
+		}
+	}
+	delist := "0"
+	if ev.Delist {
+		delist = "1"
+	}
+	var buyer string
+	var offer []byte
+	if ev.Offer != nil {
+		buyer = ev.Offer.Buyer
+		if offer, err = json.Marshal(ev.Offer); err != nil {
+			return false, 0, err
+		}
+	}
+	res, err := applyEventScript.Run(ctx, s.rds, keys,
+		ev.ID, ev.Type, price, string(ev.Sale), ev.Resume, saleStreamMaxLen,
+		ev.Owner, string(listing), ev.Address, delist, k.ownerNfts(""), fenceFrom(ctx, collection),
+		ev.Timestamp, starts[0], starts[1], starts[2], buyer, string(offer),
+	).Slice()
+	if err != nil && strings.HasPrefix(err.Error(), "FENCED") {
+		return false, 0, ErrLockLost
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	if len(res) != 2 {
+		return false, 0, nil
+	}
+	if n, _ := res[0].(int64); n != 1 {
+		return false, 0, nil
+	}
+	if str, _ := res[1].(string); str != "" {
+		oldPrice, _ = strconv.ParseFloat(str, 64)
+	}
+	return true, oldPrice, nil
+}
+
+func (s *RedisStore) NftOwner(ctx context.Context, collection, address string) (string, bool, error) {
+	v, err := s.rds.Get(ctx, s.keys(collection).nftOwner(address)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+func (s *RedisStore) OwnerNfts(ctx context.Context, collection, owner string) ([]string, error) {
+	return s.rds.SMembers(ctx, s.keys(collection).ownerNfts(owner)).Result()
+}
+
+func (s *RedisStore) HolderCount(ctx context.Context, collection string) (int64, error) {
+	return s.rds.HLen(ctx, s.keys(collection).holders()).Result()
+}
+
+func (s *RedisStore) SetNftOwner(ctx context.Context, collection, address, owner string) error {
+	k := s.keys(collection)
+	return setOwnerScript.Run(ctx, s.rds,
+		[]string{k.nftOwner(address), k.holders()},
+		k.ownerNfts(""), address, owner,
+	).Err()
+}
+
+func (s *RedisStore) ClaimOwnerCheck(ctx context.Context, collection, owner string, ttl time.Duration) (bool, error) {
+	return s.rds.SetNX(ctx, s.keys(collection).ownerChecked(owner), 1, ttl).Result()
+}
+
+func (s *RedisStore) NftListing(ctx context.Context, collection, address string) (*Listing, error) {
+	v, err := s.rds.HGet(ctx, s.keys(collection).listings(), address).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var l Listing
+	if err := json.Unmarshal(v, &l); err != nil {
+		return nil, fmt.Errorf("выставление %s: %w", address, err)
+	}
+	return &l, nil
+}
+
+func (s *RedisStore) Listings(ctx context.Context, collection string) (map[string]Listing, error) {
+	all, err := s.rds.HGetAll(ctx, s.keys(collection).listings()).Result()
+	if err != nil {
+		return nil, err
+	}
+	listings := make(map[string]Listing, len(all))
+	for addr, v := range all {
+		var l Listing
+		if err := json.Unmarshal([]byte(v), &l); err != nil {
+			return nil, fmt.Errorf("выставление %s: %w", addr, err)
+		}
+		listings[addr] = l
+	}
+	return listings, nil
+}
+
+// NftOffers читает предложения NFT, отбрасывая отозванные
+func (s *RedisStore) NftOffers(ctx context.Context, collection, address string) ([]Offer, error) {
+	all, err := s.rds.HGetAll(ctx, s.keys(collection).nftOffers(address)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var offers []Offer
+	for buyer, v := range all {
+		var o Offer
+		if err := json.Unmarshal([]byte(v), &o); err != nil {
+			return nil, fmt.Errorf("предложение %s: %w", buyer, err)
+		}
+		if !o.Cancelled {
+			offers = append(offers, o)
+		}
+	}
+	sortOffers(offers)
+	return offers, nil
+}
+
+func (s *RedisStore) Cursor(ctx context.Context, collection string) (string, error) {
+	v, err := s.rds.Get(ctx, s.keys(collection).cursor()).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return v, err
+}
+
+func (s *RedisStore) SetCursor(ctx context.Context, collection, cursor string) error {
+	return s.fencedSet(ctx, collection, s.keys(collection).cursor(), cursor)
+}
+
+func (s *RedisStore) LastTS(ctx context.Context, collection string) (int64, error) {
+	return getInt64(ctx, s.rds, s.keys(collection).lastTS())
+}
+
+func (s *RedisStore) SetLastTS(ctx context.Context, collection string, ts int64) error {
+	return s.fencedSet(ctx, collection, s.keys(collection).lastTS(), ts)
+}
+
+func (s *RedisStore) Backfill(ctx context.Context, collection string) (BackfillProgress, error) {
+	var p BackfillProgress
+	v, err := s.rds.Get(ctx, s.keys(collection).backfill()).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(v, &p)
+	return p, err
+}
+
+func (s *RedisStore) SetBackfill(ctx context.Context, collection string, p BackfillProgress) error {
+	v, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.fencedSet(ctx, collection, s.keys(collection).backfill(), v)
+}
+
+func (s *RedisStore) Flag(ctx context.Context, collection, name string) (bool, error) {
+	v, err := s.rds.Get(ctx, s.keys(collection).flag(name)).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	return v == "true", err
+}
+
+func (s *RedisStore) SetFlag(ctx context.Context, collection, name string, value bool) error {
+	return s.fencedSet(ctx, collection, s.keys(collection).flag(name), strconv.FormatBool(value))
+}
+
+func (s *RedisStore) PushSale(ctx context.Context, collection string, sale []byte) error {
+	return s.rds.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.keys(collection).saleStream(),
+		MaxLen: saleStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"sale": sale},
+	}).Err()
+}
+
+// ReadSale читает поток продаж через группу saleGroup. Группа создаётся при первом чтении.
+func (s *RedisStore) ReadSale(ctx context.Context, collection, consumer string) (*SaleMessage, error) {
+	msg, err := s.readSale(ctx, collection, consumer)
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		err = s.rds.XGroupCreateMkStream(ctx, s.keys(collection).saleStream(), saleGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+		msg, err = s.readSale(ctx, collection, consumer)
+	}
+	return msg, err
+}
+
+func (s *RedisStore) readSale(ctx context.Context, collection, consumer string) (*SaleMessage, error) {
+	stream := s.keys(collection).saleStream()
+
+	// продажи, которые кто-то взял и не подтвердил за saleClaimIdle
+	pending, err := s.rds.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  saleGroup,
+		Idle:   saleClaimIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		claimed, err := s.rds.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    saleGroup,
+			Consumer: consumer,
+			MinIdle:  saleClaimIdle,
+			Messages: []string{pending[0].ID},
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		// пустой ответ — запись уже забрал другой экземпляр или она вытеснена MAXLEN
+		if len(claimed) > 0 {
+			return saleMessage(claimed[0], pending[0].RetryCount+1), nil
+		}
+		if err := s.rds.XAck(ctx, stream, saleGroup, pending[0].ID).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	streams, err := s.rds.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    saleGroup,
+		Consumer: consumer,
+		Streams:  []string{stream, ">"},
+		Count:    1,
+		Block:    saleReadBlock,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return nil, nil
+	}
+	return saleMessage(streams[0].Messages[0], 1), nil
+}
+
+func saleMessage(m redis.XMessage, deliveries int64) *SaleMessage {
+	data, _ := m.Values["sale"].(string)
+	return &SaleMessage{ID: m.ID, Data: []byte(data), Deliveries: deliveries}
+}
+
+func (s *RedisStore) AckSale(ctx context.Context, collection, id string) error {
+	return s.rds.XAck(ctx, s.keys(collection).saleStream(), saleGroup, id).Err()
+}
+
+func (s *RedisStore) CachedPrice(ctx context.Context, key string) (float64, bool, error) {
+	return s.getPrice(ctx, s.prefix+key)
+}
+
+func (s *RedisStore) CachePrice(ctx context.Context, key string, value float64, ttl time.Duration) error {
+	pipe := s.rds.Pipeline()
+	pipe.Set(ctx, s.prefix+key, value, ttl)
+	pipe.Set(ctx, s.prefix+"last:"+key, value, 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) LastPrice(ctx context.Context, key string) (float64, bool, error) {
+	return s.getPrice(ctx, s.prefix+"last:"+key)
+}
+
+func (s *RedisStore) getPrice(ctx context.Context, key string) (float64, bool, error) {
+	v, err := s.rds.Get(ctx, key).Float64()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// floorSamplesKey — снимки флора продукта: ZSET, вес — время снимка
+func (s *RedisStore) floorSamplesKey(product string) string {
+	return s.prefix + "floor:samples:" + product
+}
+
+func (s *RedisStore) AddFloorSample(ctx context.Context, product string, sample FloorSample) error {
+	v, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	key := s.floorSamplesKey(product)
+	ts := strconv.FormatInt(sample.TS, 10)
+	pipe := s.rds.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, ts, ts)
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(sample.TS), Member: v})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(sample.TS-floorSampleRetention.Milliseconds(), 10))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) FloorSampleAt(ctx context.Context, product string, ts int64) (*FloorSample, error) {
+	vals, err := s.rds.ZRevRangeByScore(ctx, s.floorSamplesKey(product), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(ts, 10),
+		Count: 1,
+	}).Result()
+	if err != nil || len(vals) == 0 {
+		return nil, err
+	}
+	var sample FloorSample
+	if err := json.Unmarshal([]byte(vals[0]), &sample); err != nil {
+		return nil, err
+	}
+	return &sample, nil
+}
+
+func (s *RedisStore) Status(ctx context.Context, name string) (string, error) {
+	v, err := s.rds.Get(ctx, s.prefix+"process:"+name).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return v, err
+}
+
+func (s *RedisStore) SetStatus(ctx context.Context, name, status string) error {
+	return s.rds.Set(ctx, s.prefix+"process:"+name, status, 0).Err()
+}
@@ -0,0 +1,182 @@
+package botutils
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"tg-getgems-bot/getgems"
+)
+
+// storeSnapshot — всё, что индексатор записывает в Store, в сравнимом виде
+type storeSnapshot struct {
+	Prices     map[string]float64
+	PriceRange []float64
+	Below2     int64
+	Sum        float64
+	Count      int64
+	Owners     map[string]string
+	OwnerNfts  map[string][]string
+	Holders    int64
+	Listings   map[string]Listing
+	Offers     map[string][]Offer
+	Sales      map[string]int64
+	Candles    []Candle
+	Cursor     string
+}
+
+func snapshotStore(t *testing.T, st Store, addrs, owners []string, ts []int64) storeSnapshot {
+	t.Helper()
+	c := testCollection()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var s storeSnapshot
+	var err error
+	s.Prices, err = st.NftPrices(Ctx, c)
+	check(err)
+	s.PriceRange, err = st.PriceRange(Ctx, c, 0, -1)
+	check(err)
+	s.Below2, err = st.PriceCountBetween(Ctx, c, math.Inf(-1), 2)
+	check(err)
+	s.Sum, s.Count, err = st.Aggregate(Ctx, c)
+	check(err)
+	// INCRBYFLOAT в Redis и сложение в Go округляют по-разному
+	s.Sum = math.Round(s.Sum*1e6) / 1e6
+
+	s.Owners = make(map[string]string)
+	s.Offers = make(map[string][]Offer)
+	for _, addr := range addrs {
+		owner, ok, err := st.NftOwner(Ctx, c, addr)
+		check(err)
+		if ok {
+			s.Owners[addr] = owner
+		}
+		offers, err := st.NftOffers(Ctx, c, addr)
+		check(err)
+		if len(offers) > 0 {
+			s.Offers[addr] = offers
+		}
+	}
+	s.OwnerNfts = make(map[string][]string)
+	for _, owner := range owners {
+		nfts, err := st.OwnerNfts(Ctx, c, owner)
+		check(err)
+		sort.Strings(nfts)
+		if len(nfts) > 0 {
+			s.OwnerNfts[owner] = nfts
+		}
+	}
+	s.Holders, err = st.HolderCount(Ctx, c)
+	check(err)
+	s.Listings, err = st.Listings(Ctx, c)
+	check(err)
+
+	s.Sales = make(map[string]int64)
+	for _, at := range ts {
+		for period, bucket := range map[string]string{"day": dayKey(at), "week": weekKey(at), "month": monthKey(at)} {
+			n, err := st.SalesCount(Ctx, c, period, bucket)
+			check(err)
+			s.Sales[period+":"+bucket] = n
+		}
+	}
+	s.Candles, err = st.Candles(Ctx, c, "1h", 0, math.MaxInt64)
+	check(err)
+	s.Cursor, err = st.Cursor(Ctx, c)
+	check(err)
+	return s
+}
+
+// TestRedisMemoryParity прогоняет одну и ту же историю через RedisStore (miniredis)
+// и MemoryStore: applyEventScript и его копия в Go должны давать одинаковое состояние
+func TestRedisMemoryParity(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rds := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rds.Close()
+
+	const hour = int64(3600 * 1000)
+	base := int64(1700000000000)
+	nft3 := "EQnft3"
+
+	// события вперемешку: поздние раньше ранних, повторы, сожжение
+	history := []getgems.HistoryItem{
+		mintItem(testNft1, base, "o1"),
+		soldItem(testNft1, base+2*hour, "o1", "o2", 3),
+		// старые передача и минт после продажи
+		transferItem(testNft1, base+hour, "o1", "o3"),
+		mintItem(testNft2, base+10, "o2"),
+		listItem(testNft2, base+hour, "o2", 5),
+		offerItem(testNft2, base+hour+1, "b1", 1.5),
+		offerItem(testNft2, base+hour+2, "b2", 1.8),
+		// отзыв предложения b1 и более старое предложение, пришедшее после отзыва
+		historyItem(getgems.TypeCancelOffer, testNft2, base+hour+3, "b1", ""),
+		offerItem(testNft2, base+hour, "b1", 1.6),
+		// продажа по предложению b2 закрывает его и снимает выставление
+		soldItem(testNft2, base+3*hour, "o2", "b2", 1.8),
+		// старая продажа не переписывает цену, но учитывается в счётчиках
+		soldItem(testNft2, base+2*hour, "o2", "o4", 4),
+		mintItem(nft3, base+20, "o3"),
+		listItem(nft3, base+30, "o3", 7),
+		offerItem(nft3, base+40, "b1", 1),
+		historyItem(getgems.TypeBurn, nft3, base+5*hour, "", "o3"),
+		transferItem(nft3, base+4*hour, "o3", "o5"),
+		// продажа по той же цене
+		soldItem(testNft1, base+6*hour, "o2", "o5", 3),
+	}
+
+	addrs := []string{testNft1, testNft2, nft3}
+	owners := []string{"o1", "o2", "o3", "o4", "o5", "b2"}
+	var ts []int64
+	for _, item := range history {
+		ts = append(ts, item.Timestamp)
+	}
+
+	stores := map[string]Store{
+		"redis":  NewRedisStore(rds),
+		"memory": NewMemoryStore(),
+	}
+	snapshots := make(map[string]storeSnapshot)
+	for name, st := range stores {
+		for pass := 0; pass < 2; pass++ {
+			for i, item := range history {
+				resume := "c" + string(rune('a'+i))
+				if _, err := applyHistoryItem(Ctx, st, testCollection(), item, resume, 1.4, false); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+			}
+		}
+		snapshots[name] = snapshotStore(t, st, addrs, owners, ts)
+	}
+
+	got, want := snapshots["redis"], snapshots["memory"]
+	if !reflect.DeepEqual(got, want) {
+		v1, v2 := reflect.ValueOf(got), reflect.ValueOf(want)
+		for i := 0; i < v1.NumField(); i++ {
+			if !reflect.DeepEqual(v1.Field(i).Interface(), v2.Field(i).Interface()) {
+				t.Errorf("%s: redis %+v, memory %+v", v1.Type().Field(i).Name, v1.Field(i).Interface(), v2.Field(i).Interface())
+			}
+		}
+	}
+
+	// и само состояние верное, а не одинаково неверное
+	if want.Prices[testNft1] != 3 || want.Prices[testNft2] != 1.8 || want.Prices[nft3] != 1.4 {
+		t.Errorf("цены %v", want.Prices)
+	}
+	if _, ok := want.Owners[nft3]; ok || want.Owners[testNft1] != "o5" || want.Owners[testNft2] != "b2" {
+		t.Errorf("владельцы %v", want.Owners)
+	}
+	if len(want.Listings) != 0 {
+		t.Errorf("выставления %v", want.Listings)
+	}
+	if offers := want.Offers[testNft2]; len(offers) != 0 {
+		t.Errorf("предложения %+v", offers)
+	}
+}
@@ -2,6 +2,7 @@ package botutils
 
 import (
 	"context"
+	"errors"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -23,3 +24,19 @@ func SetValue(client *redis.Client, key string, value interface{}) error {
 func GetValue(client *redis.Client, key string) (string, error) {
 	return client.Get(Ctx, key).Result()
 }
+
+func getInt64(ctx context.Context, rds *redis.Client, key string) (int64, error) {
+	v, err := rds.Get(ctx, key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return v, err
+}
+
+func getFloat64(ctx context.Context, rds *redis.Client, key string) (float64, error) {
+	v, err := rds.Get(ctx, key).Float64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return v, err
+}
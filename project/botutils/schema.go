@@ -0,0 +1,293 @@
+package botutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// schemaVersionKey хранит версию раскладки ключей в Redis
+const schemaVersionKey = "schema:version"
+
+// migrateLockKey не даёт двум репликам мигрировать одновременно
+const migrateLockKey = "lock:schema_migrate"
+
+// migration переводит ключи с версии version-1 на version.
+// up должна быть идемпотентной: после сбоя миграция повторяется целиком.
+// Имена ключей в up пишутся литералами, а не через текущие помощники вроде liveKeys:
+// переименование ключа в новой версии не должно менять то, что делает старая миграция.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, rds *redis.Client) error
+}
+
+// migrations — по порядку версий; новые добавляются в конец
+var migrations = []migration{
+	{1, "продажи и очередь уведомлений по коллекциям", migratePerCollectionSales},
+	{2, "очередь уведомлений в Redis Stream", migrateSalesToStream},
+	{3, "владельцы и выставления из всех типов событий (пересборку назначает версия 6)", migrateReplayAllTypes},
+	{4, "множества NFT владельцев", migrateOwnerSets},
+	{5, "отсортированные цены NFT для медианы", migratePriceIndex},
+	{6, "активные предложения на NFT: назначить пересборку индекса", migrateOffers},
+}
+
+// SchemaVersion — версия, до которой мигрирует этот бот
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate доводит раскладку ключей до текущей версии, не трогая остальные данные.
+// База от более новой версии бота — ошибка: старый код может её испортить.
+// Блокировка миграции продлевается, пока миграция идёт, и снимается только своим держателем.
+func Migrate(ctx context.Context, rds *redis.Client) error {
+	holder := "migrate@" + InstanceName()
+	lock, err := tryLock(ctx, rds, migrateLockKey, holder)
+	if err == nil && lock == nil {
+		log.Println("[Schema] миграцию выполняет другая реплика, ждём...")
+		lock, err = acquireLock(ctx, rds, migrateLockKey, holder)
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	ctx = lock.Context()
+
+	current, err := getInt64(ctx, rds, schemaVersionKey)
+	if err != nil {
+		return err
+	}
+	if int(current) > SchemaVersion() {
+		return fmt.Errorf("версия схемы Redis %d новее поддерживаемой %d", current, SchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= int(current) {
+			continue
+		}
+		log.Printf("[Schema] миграция %d: %s", m.version, m.name)
+		if err := m.up(ctx, rds); err != nil {
+			return fmt.Errorf("миграция %d (%s): %w", m.version, m.name, err)
+		}
+		// версию пишет только тот, кто всё ещё держит блокировку миграции
+		err := fencedSetScript.Run(ctx, rds,
+			[]string{schemaVersionKey, fenceKeyOf(migrateLockKey)}, m.version, lock.Token,
+		).Err()
+		if err != nil && strings.HasPrefix(err.Error(), "FENCED") {
+			return fmt.Errorf("миграция %d: блокировка миграции потеряна", m.version)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("[Schema] версия схемы %d", SchemaVersion())
+	return nil
+}
+
+// migratePerCollectionSales переносит общие счётчики продаж и очередь уведомлений,
+// которые были до поддержки нескольких коллекций, на коллекцию продукта по умолчанию
+func migratePerCollectionSales(ctx context.Context, rds *redis.Client) error {
+	collection := DefaultProduct().FragmentCollection
+
+	for _, period := range []string{"day", "week", "month"} {
+		prefix := "collection:sales:" + period + ":"
+		keys, err := scanKeys(ctx, rds, prefix+"*")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			n, err := rds.Get(ctx, key).Int64()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			pipe := rds.TxPipeline()
+			pipe.IncrBy(ctx, "collection:sales:"+collection+":"+period+":"+strings.TrimPrefix(key, prefix), n)
+			pipe.Del(ctx, key)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	// старые продажи встают в начало очереди, перед новыми
+	const legacyQueue = "collection:new_sales"
+	for {
+		err := rds.RPopLPush(ctx, legacyQueue, "collection:new_sales:"+collection).Err()
+		if errors.Is(err, redis.Nil) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return rds.Del(ctx, "process:collection_indexing").Err()
+}
+
+// migrateSalesToStream переносит неотправленные продажи из списков в потоки
+func migrateSalesToStream(ctx context.Context, rds *redis.Client) error {
+	for _, p := range Products() {
+		legacy := "collection:new_sales:" + p.FragmentCollection
+		for {
+			sale, err := rds.LIndex(ctx, legacy, 0).Bytes()
+			if errors.Is(err, redis.Nil) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			err = rds.XAdd(ctx, &redis.XAddArgs{
+				Stream: "collection:sales_stream:" + p.FragmentCollection,
+				MaxLen: 10000,
+				Approx: true,
+				Values: map[string]interface{}{"sale": sale},
+			}).Err()
+			if err != nil {
+				return err
+			}
+			// удаляем только после записи в поток; при сбое продажа может повториться, но не потеряется
+			if err := rds.LPop(ctx, legacy).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateReplayAllTypes раньше сама пересобирала индекс, чтобы собрать владельцев
+// и выставления. Теперь пересборку назначает migrateOffers — одну на обе версии.
+func migrateReplayAllTypes(ctx context.Context, rds *redis.Client) error {
+	return nil
+}
+
+// migrateOffers назначает пересборку индекса: события предложений уже учтены
+// индексатором, но раньше не сохранялись, а до версии 3 и владельцы с выставлениями.
+// Сама пересборка ходит в API и может идти часами, поэтому не задерживает запуск:
+// её выполняет ReindexWhenRequested в фоне.
+// Коллекции, которые ещё не начинали индексировать, собирать заново нечего.
+func migrateOffers(ctx context.Context, rds *redis.Client) error {
+	for _, p := range Products() {
+		c := p.FragmentCollection
+		started, err := rds.Exists(ctx, "collection:"+c+":indexed", "collection:cursor:"+c).Result()
+		if err != nil {
+			return err
+		}
+		if started == 0 {
+			continue
+		}
+		if err := rds.Set(ctx, "collection:"+c+":reindex", "true", 0).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateOwnerSets собирает множества NFT владельцев и число держателей
+// из уже записанных владельцев NFT. Собранное ранее удаляется, чтобы повтор не задвоил счётчики.
+func migrateOwnerSets(ctx context.Context, rds *redis.Client) error {
+	for _, p := range Products() {
+		c := p.FragmentCollection
+		holders := "collection:holders:" + c
+		stale, err := scanKeys(ctx, rds, "owner:nfts:"+c+":*")
+		if err != nil {
+			return err
+		}
+		if err := rds.Del(ctx, append(stale, holders)...).Err(); err != nil {
+			return err
+		}
+
+		ownerPrefix := "nft:owner:" + c + ":"
+		ownerKeys, err := scanKeys(ctx, rds, ownerPrefix+"*")
+		if err != nil {
+			return err
+		}
+		for _, key := range ownerKeys {
+			owner, err := rds.Get(ctx, key).Result()
+			if errors.Is(err, redis.Nil) || owner == "" {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			pipe := rds.TxPipeline()
+			pipe.SAdd(ctx, "owner:nfts:"+c+":"+owner, strings.TrimPrefix(key, ownerPrefix))
+			pipe.HIncrBy(ctx, holders, owner, 1)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migratePriceIndex собирает ZSET цен коллекции из nft:last_price:*
+func migratePriceIndex(ctx context.Context, rds *redis.Client) error {
+	for _, p := range Products() {
+		c := p.FragmentCollection
+		pricePrefix := "nft:last_price:" + c + ":"
+		keys, err := scanKeys(ctx, rds, pricePrefix+"*")
+		if err != nil {
+			return err
+		}
+		const batch = 500
+		for start := 0; start < len(keys); start += batch {
+			end := start + batch
+			if end > len(keys) {
+				end = len(keys)
+			}
+			values, err := rds.MGet(ctx, keys[start:end]...).Result()
+			if err != nil {
+				return err
+			}
+			var members []*redis.Z
+			for i, v := range values {
+				str, ok := v.(string)
+				if !ok {
+					continue
+				}
+				price, err := strconv.ParseFloat(str, 64)
+				if err != nil {
+					continue
+				}
+				members = append(members, &redis.Z{Score: price, Member: strings.TrimPrefix(keys[start+i], pricePrefix)})
+			}
+			if len(members) == 0 {
+				continue
+			}
+			if err := rds.ZAdd(ctx, "collection:prices:"+c, members...).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WipeCollection удаляет индекс коллекции, чтобы индексатор собрал его заново.
+// Остальные данные в Redis не трогаются.
+func WipeCollection(ctx context.Context, rds *redis.Client, collection string) error {
+	lock, err := AcquireIndexLock(ctx, rds, collection, "wipe@"+InstanceName())
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	ctx = lock.Context()
+
+	live := liveKeys(collection)
+	if err := deleteIndexKeys(ctx, rds, live); err != nil {
+		return err
+	}
+	pipe := rds.TxPipeline()
+	// собранный заново индекс уже в текущей раскладке — назначенная пересборка не нужна
+	pipe.Del(ctx, live.saleStream(), live.flag(flagPrimaryDone), live.flag(flagReindex))
+	pipe.Set(ctx, live.flag(flagIndexed), strconv.FormatBool(false), 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	log.Printf("[Schema] индекс коллекции %s удалён", collection)
+	return nil
+}
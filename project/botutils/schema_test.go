@@ -0,0 +1,55 @@
+package botutils
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// TestMigrateSchedulesReindex — миграция не ходит в API, а назначает пересборку
+// начатым коллекциям; незавершённый первичный проход пересборка начинает заново
+func TestMigrateSchedulesReindex(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rds := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rds.Close()
+	c := testCollection()
+	live := NewRedisStore(rds)
+
+	mr.Set(schemaVersionKey, "2")
+	applyItems(t, live, mintItem(testNft1, 1000, "o1"))
+	live.SetCursor(Ctx, c, "p2")
+
+	if err := Migrate(Ctx, rds); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := mr.Get(schemaVersionKey); v != "6" {
+		t.Errorf("версия схемы %s, ожидалась 6", v)
+	}
+	if requested, _ := live.Flag(Ctx, c, flagReindex); !requested {
+		t.Fatal("пересборка не назначена")
+	}
+
+	// первичный проход не завершён: индекс сбрасывается без запросов к API
+	if err := reindexIfRequested(Ctx, rds, c); err != nil {
+		t.Fatal(err)
+	}
+	if requested, _ := live.Flag(Ctx, c, flagReindex); requested {
+		t.Error("назначение пересборки не снято")
+	}
+	if cursor, _ := live.Cursor(Ctx, c); cursor != "" {
+		t.Errorf("курсор %q не сброшен", cursor)
+	}
+	if _, ok, _ := live.NftPrice(Ctx, c, testNft1); ok {
+		t.Error("цена NFT из незавершённого прохода не удалена")
+	}
+
+	// новая база: индексировать ещё нечего, пересборка не назначается
+	mr.FlushAll()
+	if err := Migrate(Ctx, rds); err != nil {
+		t.Fatal(err)
+	}
+	if requested, _ := live.Flag(Ctx, c, flagReindex); requested {
+		t.Error("пересборка назначена пустой базе")
+	}
+}
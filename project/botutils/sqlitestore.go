@@ -0,0 +1,278 @@
+package botutils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"tg-getgems-bot/getgems"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema — таблица событий истории. id — lt:hash, повторная вставка игнорируется.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	id         TEXT PRIMARY KEY,
+	collection TEXT NOT NULL,
+	address    TEXT NOT NULL,
+	name       TEXT NOT NULL DEFAULT '',
+	type       TEXT NOT NULL,
+	price      REAL NOT NULL,
+	currency   TEXT NOT NULL DEFAULT '',
+	new_owner  TEXT NOT NULL DEFAULT '',
+	old_owner  TEXT NOT NULL DEFAULT '',
+	ts         INTEGER NOT NULL,
+	lt         INTEGER NOT NULL DEFAULT 0,
+	hash       TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS events_address ON events(collection, address, ts);
+CREATE INDEX IF NOT EXISTS events_type_ts ON events(collection, type, ts);
+`
+
+// pricedEventsSQL отбирает события, задающие цену NFT: минт и продажу в TON.
+// Остальные типы хранятся для истории, у выставлений в price — цена выставления.
+const pricedEventsSQL = `type IN ('mint', 'sold') AND price > 0`
+
+// lastPricesSQL — последняя цена каждой NFT коллекции: цена её самого позднего минта или продажи
+const lastPricesSQL = `
+SELECT address, price FROM (
+	SELECT address, price,
+		ROW_NUMBER() OVER (PARTITION BY address ORDER BY ts DESC, lt DESC) AS rn
+	FROM events WHERE collection = ? AND ` + pricedEventsSQL + `
+) WHERE rn = 1`
+
+// SQLiteStore хранит каждое применённое событие истории в SQLite, а Redis (cache)
+// остаётся быстрым кэшем перед ней. Если Redis вытеснил ключ (allkeys-lru), следующее
+// событие создаёт его заново только из себя, и кэш отвечает неполными данными, которые
+// не отличить от полных. Поэтому агрегаты, счётчики продаж, свечи и распределение цен
+// читаются из SQL; из кэша — только то, что одно событие задаёт целиком (цена NFT).
+type SQLiteStore struct {
+	Store
+	db *sql.DB
+}
+
+// OpenSQLiteStore открывает (и при необходимости создаёт) базу событий по пути path
+func OpenSQLiteStore(path string, cache Store) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// один писатель: SQLite всё равно сериализует запись
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &SQLiteStore{Store: cache, db: db}, nil
+}
+
+// Close закрывает базу
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// ApplyEvent сначала надёжно записывает событие в SQLite, затем применяет его в кэше.
+// При сбое между шагами повтор страницы не задвоит событие ни там, ни там.
+func (s *SQLiteStore) ApplyEvent(ctx context.Context, collection string, ev IndexEvent) (bool, float64, error) {
+	lt, _ := strconv.ParseInt(ev.Lt, 10, 64)
+	// у минта и продажи — их цена; у выставления и предложения — цена выставления
+	// или предложения. Продажа тоже закрывает предложение, но его цену не берём.
+	price := ev.Price
+	if !ev.HasPrice {
+		switch ev.Type {
+		case getgems.TypePutUpForSale, getgems.TypePutUpForAuction:
+			if ev.Listing != nil {
+				price = ev.Listing.Price
+			}
+		case getgems.TypeOffer:
+			if ev.Offer != nil {
+				price = ev.Offer.Price
+			}
+		}
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO events
+			(id, collection, address, name, type, price, currency, new_owner, old_owner, ts, lt, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ev.ID, collection, ev.Address, ev.Name, ev.Type, price, ev.Currency,
+		ev.NewOwner, ev.OldOwner, ev.Timestamp, lt, ev.Hash,
+	)
+	if err != nil {
+		return false, 0, fmt.Errorf("sqlite: %w", err)
+	}
+	return s.Store.ApplyEvent(ctx, collection, ev)
+}
+
+// NftPrice берёт цену из кэша, а если её там нет — из последнего минта или продажи NFT
+func (s *SQLiteStore) NftPrice(ctx context.Context, collection, address string) (float64, bool, error) {
+	if v, ok, err := s.Store.NftPrice(ctx, collection, address); err == nil && ok {
+		return v, true, nil
+	}
+	var price float64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT price FROM events WHERE collection = ? AND address = ? AND `+pricedEventsSQL+`
+		ORDER BY ts DESC, lt DESC LIMIT 1`, collection, address).Scan(&price)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return price, true, nil
+}
+
+// NftPrices — последние цены всех NFT по данным SQLite
+func (s *SQLiteStore) NftPrices(ctx context.Context, collection string) (map[string]float64, error) {
+	rows, err := s.db.QueryContext(ctx, lastPricesSQL, collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := make(map[string]float64)
+	for rows.Next() {
+		var addr string
+		var price float64
+		if err := rows.Scan(&addr, &price); err != nil {
+			return nil, err
+		}
+		prices[addr] = price
+	}
+	return prices, rows.Err()
+}
+
+// Aggregate — сумма и количество последних цен NFT по данным SQL
+func (s *SQLiteStore) Aggregate(ctx context.Context, collection string) (float64, int64, error) {
+	var sum float64
+	var count int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(price), 0), COUNT(*) FROM ("+lastPricesSQL+")", collection,
+	).Scan(&sum, &count)
+	if err != nil {
+		return 0, 0, err
+	}
+	return sum, count, nil
+}
+
+// PriceRange — цены NFT по возрастанию по данным SQL
+func (s *SQLiteStore) PriceRange(ctx context.Context, collection string, start, stop int64) ([]float64, error) {
+	limit := stop - start + 1
+	if stop < 0 {
+		limit = -1 // LIMIT -1 — до конца
+	}
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT price FROM ("+lastPricesSQL+") ORDER BY price LIMIT ? OFFSET ?",
+		collection, limit, start,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prices []float64
+	for rows.Next() {
+		var price float64
+		if err := rows.Scan(&price); err != nil {
+			return nil, err
+		}
+		prices = append(prices, price)
+	}
+	return prices, rows.Err()
+}
+
+// PriceCountBetween — число NFT с последней ценой в [min, max) по данным SQL
+func (s *SQLiteStore) PriceCountBetween(ctx context.Context, collection string, min, max float64) (int64, error) {
+	query := "SELECT COUNT(*) FROM (" + lastPricesSQL + ") WHERE 1"
+	args := []interface{}{collection}
+	if !math.IsInf(min, -1) {
+		query += " AND price >= ?"
+		args = append(args, min)
+	}
+	if !math.IsInf(max, 1) {
+		query += " AND price < ?"
+		args = append(args, max)
+	}
+	var n int64
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+// SalesCount считает продажи за период в SQL
+func (s *SQLiteStore) SalesCount(ctx context.Context, collection, period, bucket string) (int64, error) {
+	from, to, err := bucketRange(period, bucket)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM events
+		WHERE collection = ? AND type = 'sold' AND price > 0 AND ts >= ? AND ts < ?`,
+		collection, from.UnixMilli(), to.UnixMilli(),
+	).Scan(&n)
+	return n, err
+}
+
+// Candles собирает свечи из продаж в SQL. Свеча может начаться до from, а продажи
+// в неё — попасть в [from, to): такие свечи собираются только из продаж внутри диапазона.
+func (s *SQLiteStore) Candles(ctx context.Context, collection, res string, from, to int64) ([]Candle, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT ts, price FROM events
+		WHERE collection = ? AND type = 'sold' AND price > 0 AND ts >= ? AND ts < ?
+		ORDER BY ts, lt`,
+		collection, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candles []Candle
+	var openTS, closeTS int64
+	for rows.Next() {
+		var ts int64
+		var price float64
+		if err := rows.Scan(&ts, &price); err != nil {
+			return nil, err
+		}
+		start, err := candleStart(res, ts)
+		if err != nil {
+			return nil, err
+		}
+		if len(candles) == 0 || candles[len(candles)-1].Start != start {
+			candles = append(candles, Candle{Start: start})
+		}
+		candles[len(candles)-1].addTrade(price, ts, &openTS, &closeTS)
+	}
+	return candles, rows.Err()
+}
+
+// bucketRange переводит корзину счётчика продаж (dayKey/weekKey/monthKey) в интервал времени [from, to)
+func bucketRange(period, bucket string) (from, to time.Time, err error) {
+	switch period {
+	case "day":
+		from, err = time.Parse("20060102", bucket)
+		return from, from.AddDate(0, 0, 1), err
+	case "month":
+		from, err = time.Parse("200601", bucket)
+		return from, from.AddDate(0, 1, 0), err
+	case "week":
+		if len(bucket) != 6 {
+			return from, to, fmt.Errorf("неверная неделя %q", bucket)
+		}
+		year, err1 := strconv.Atoi(bucket[:4])
+		week, err2 := strconv.Atoi(bucket[4:])
+		if err1 != nil || err2 != nil {
+			return from, to, fmt.Errorf("неверная неделя %q", bucket)
+		}
+		// 4 января всегда в первой ISO-неделе года
+		jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)
+		monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+		from = monday.AddDate(0, 0, 7*(week-1))
+		return from, from.AddDate(0, 0, 7), nil
+	}
+	return from, to, fmt.Errorf("неизвестный период %q", period)
+}
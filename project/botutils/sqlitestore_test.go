@@ -0,0 +1,126 @@
+package botutils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func openTestSQLite(t *testing.T) *SQLiteStore {
+	t.Helper()
+	st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "events.db"), NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// TestSQLiteStorePricedEvents — в агрегаты, счётчики и свечи SQL идут только минт
+// и продажа по своей цене; выставления и предложения их не меняют
+func TestSQLiteStorePricedEvents(t *testing.T) {
+	st := openTestSQLite(t)
+	c := testCollection()
+	const hour = int64(3600 * 1000)
+	base := int64(1700000000000)
+
+	applyItems(t, st,
+		mintItem(testNft1, base, "o1"),
+		mintItem(testNft2, base+1, "o2"),
+		offerItem(testNft1, base+hour, "b1", 4),
+		listItem(testNft2, base+hour+1, "o2", 9),
+		soldItem(testNft1, base+2*hour, "o1", "b1", 5),
+		offerItem(testNft2, base+2*hour+1, "b2", 7),
+	)
+
+	if sum, count, err := st.Aggregate(Ctx, c); err != nil || !approx(sum, 6.4) || count != 2 {
+		t.Errorf("агрегат %g/%d (%v), ожидалось 6.4/2", sum, count, err)
+	}
+	if price, ok, _ := st.NftPrice(Ctx, c, testNft1); !ok || price != 5 {
+		t.Errorf("цена %g (%v), ожидалась цена продажи 5", price, ok)
+	}
+	for period, bucket := range map[string]string{
+		"day":   dayKey(base + 2*hour),
+		"week":  weekKey(base + 2*hour),
+		"month": monthKey(base + 2*hour),
+	} {
+		if n, err := st.SalesCount(Ctx, c, period, bucket); err != nil || n != 1 {
+			t.Errorf("продаж за %s %d (%v), ожидалась 1", period, n, err)
+		}
+	}
+	if prices, _ := st.PriceRange(Ctx, c, 0, -1); len(prices) != 2 || prices[0] != 1.4 || prices[1] != 5 {
+		t.Errorf("цены по возрастанию %v, ожидалось [1.4 5]", prices)
+	}
+
+	candles, err := st.Candles(Ctx, c, "1h", base, base+3*hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, _ := candleStart("1h", base+2*hour)
+	if len(candles) != 1 {
+		t.Fatalf("свечей %d, ожидалась одна: %+v", len(candles), candles)
+	}
+	if cd := candles[0]; cd.Start != start || cd.Open != 5 || cd.Close != 5 || cd.Volume != 5 || cd.Trades != 1 {
+		t.Errorf("свеча %+v", cd)
+	}
+}
+
+// TestSQLiteStoreSurvivesEviction — Redis вытеснил агрегаты, свечи и цену NFT, и следующее
+// событие создало их заново только из себя; SQLiteStore и сверка индекса всё равно видят полную историю
+func TestSQLiteStoreSurvivesEviction(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rds := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rds.Close()
+	st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "events.db"), NewRedisStore(rds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	c := testCollection()
+	const hour = int64(3600 * 1000)
+	base := int64(1699920000000) // полночь UTC: все события в одной дневной свече
+
+	applyItems(t, st,
+		mintItem(testNft1, base, "o1"),
+		mintItem(testNft2, base+1, "o2"),
+		soldItem(testNft1, base+hour, "o1", "o3", 2),
+	)
+	k := liveKeys(c)
+	start, _ := candleStart("1d", base)
+	mr.Del(k.sum())
+	mr.Del(k.count())
+	mr.Del(k.nftPrice(testNft1))
+	mr.Del(k.sales("day", dayKey(base)))
+	mr.Del(k.candle("1d", strconv.FormatInt(start, 10)))
+	applyItems(t, st, soldItem(testNft2, base+2*hour, "o2", "o4", 3))
+
+	if sum, count, _ := st.Aggregate(Ctx, c); !approx(sum, 5) || count != 2 {
+		t.Errorf("агрегат %g/%d, ожидалось 5/2", sum, count)
+	}
+	if n, _ := st.SalesCount(Ctx, c, "day", dayKey(base)); n != 2 {
+		t.Errorf("продаж за день %d, ожидалось 2", n)
+	}
+	day := time.UnixMilli(base).UTC().Truncate(24 * time.Hour)
+	candles, err := GetOHLC(st, c, Resolution1d, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candles) != 1 || candles[0].Open != 2 || candles[0].Close != 3 || candles[0].Trades != 2 {
+		t.Errorf("свечи %+v, ожидалась одна 2→3 из двух продаж", candles)
+	}
+
+	snapshot := filepath.Join(t.TempDir(), "addresses.txt")
+	os.WriteFile(snapshot, []byte(testNft1+"\n"+testNft2+"\n"), 0o644)
+	check, err := CheckCollectionIndex(Ctx, rds, st, c, snapshot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Count != 2 || len(check.Missing) != 0 || len(check.Unknown) != 0 || check.aggregateDrift() {
+		t.Errorf("сверка по SQLite: %s", check)
+	}
+}
@@ -0,0 +1,167 @@
+package botutils
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Store — хранилище состояния бота: цены, владельцы, выставления и предложения NFT, агрегаты
+// коллекций, счётчики продаж, курсор индексатора, очередь продаж для уведомлений и кэш цен.
+// RedisStore — рабочая реализация, MemoryStore — для тестов и запуска без Redis.
+type Store interface {
+	// NftPrice — последняя цена NFT; false, если цены нет
+	NftPrice(ctx context.Context, collection, address string) (float64, bool, error)
+	// NftPrices — последние цены всех NFT коллекции: адрес → цена
+	NftPrices(ctx context.Context, collection string) (map[string]float64, error)
+
+	// PriceRange — цены NFT с номерами start..stop по возрастанию (0 — самая дешёвая)
+	PriceRange(ctx context.Context, collection string, start, stop int64) ([]float64, error)
+	// PriceCountBetween — число NFT с ценой в [min, max); ±Inf — без границы
+	PriceCountBetween(ctx context.Context, collection string, min, max float64) (int64, error)
+
+	// Candles — свечи продаж разрешения res (1h/1d/1w), начавшиеся в [from, to), мс
+	Candles(ctx context.Context, collection, res string, from, to int64) ([]Candle, error)
+
+	// Aggregate — сумма последних цен и число NFT с ценой
+	Aggregate(ctx context.Context, collection string) (sum float64, count int64, err error)
+	SetAggregate(ctx context.Context, collection string, sum float64, count int64) error
+
+	// SalesCount — число продаж за период (day/week/month) в корзине bucket
+	SalesCount(ctx context.Context, collection, period, bucket string) (int64, error)
+
+	// NftOwner — текущий владелец NFT по истории; false, если неизвестен
+	NftOwner(ctx context.Context, collection, address string) (string, bool, error)
+	// OwnerNfts — NFT коллекции у владельца по истории; HolderCount — число владельцев
+	OwnerNfts(ctx context.Context, collection, owner string) ([]string, error)
+	HolderCount(ctx context.Context, collection string) (int64, error)
+	// SetNftOwner исправляет владельца NFT по данным API; пустой owner — владелец неизвестен
+	SetNftOwner(ctx context.Context, collection, address, owner string) error
+	// ClaimOwnerCheck — true, если владельца пора сверить с API: не чаще раза в ttl
+	ClaimOwnerCheck(ctx context.Context, collection, owner string, ttl time.Duration) (bool, error)
+	// NftListing — активное выставление NFT; nil, если NFT не выставлена
+	NftListing(ctx context.Context, collection, address string) (*Listing, error)
+	// Listings — все активные выставления коллекции: адрес → выставление
+	Listings(ctx context.Context, collection string) (map[string]Listing, error)
+	// NftOffers — активные предложения на NFT, по одному от каждого покупателя
+	NftOffers(ctx context.Context, collection, address string) ([]Offer, error)
+
+	// ApplyEvent атомарно применяет событие истории и двигает курсор.
+	// applied=false — событие уже было учтено; oldPrice — цена NFT до продажи.
+	// Эти записи и записи курсора, прогресса и флагов ниже проверяют токен блокировки
+	// из ctx: если её перехватили, возвращается ErrLockLost.
+	ApplyEvent(ctx context.Context, collection string, ev IndexEvent) (applied bool, oldPrice float64, err error)
+	Cursor(ctx context.Context, collection string) (string, error)
+	SetCursor(ctx context.Context, collection, cursor string) error
+	LastTS(ctx context.Context, collection string) (int64, error)
+	SetLastTS(ctx context.Context, collection string, ts int64) error
+
+	// Backfill — прогресс первичного прохода истории; SetBackfill сохраняет его.
+	// Сама точка продолжения — курсор, он двигается вместе с событиями.
+	Backfill(ctx context.Context, collection string) (BackfillProgress, error)
+	SetBackfill(ctx context.Context, collection string, p BackfillProgress) error
+
+	// Flag — флаг состояния коллекции (indexed, reindex)
+	Flag(ctx context.Context, collection, name string) (bool, error)
+	SetFlag(ctx context.Context, collection, name string, value bool) error
+
+	// PushSale публикует продажу для уведомлений.
+	// ReadSale выдаёт consumer следующую продажу — сначала давно не подтверждённые
+	// (упавший или не доставивший экземпляр), затем новые; ждёт не дольше saleReadBlock
+	// и возвращает nil, если продаж нет. AckSale подтверждает доставку: до неё
+	// продажа остаётся в очереди и будет выдана снова.
+	PushSale(ctx context.Context, collection string, sale []byte) error
+	ReadSale(ctx context.Context, collection, consumer string) (*SaleMessage, error)
+	AckSale(ctx context.Context, collection, id string) error
+
+	// CachedPrice — значение из кэша, пока не истёк ttl; CachePrice заодно
+	// запоминает его как последнее удачное, которое LastPrice отдаёт без срока
+	CachedPrice(ctx context.Context, key string) (float64, bool, error)
+	CachePrice(ctx context.Context, key string, value float64, ttl time.Duration) error
+	LastPrice(ctx context.Context, key string) (float64, bool, error)
+
+	// AddFloorSample сохраняет снимок флора продукта (снимок с тем же временем заменяется);
+	// FloorSampleAt — последний снимок не позже ts, nil — снимков нет
+	AddFloorSample(ctx context.Context, product string, s FloorSample) error
+	FloorSampleAt(ctx context.Context, product string, ts int64) (*FloorSample, error)
+
+	// Status — статус фонового процесса для /ps
+	Status(ctx context.Context, name string) (string, error)
+	SetStatus(ctx context.Context, name, status string) error
+}
+
+// Флаги коллекции
+const (
+	flagIndexed     = "indexed"            // первичная индексация завершена, данные можно показывать
+	flagPrimaryDone = "primary_index_done" // устарел: уведомлениями теперь управляет первичный проход; удаляется при сбросе
+	flagReindex     = "reindex"            // миграция требует собрать индекс заново из истории
+)
+
+// SaleMessage — продажа из очереди уведомлений
+type SaleMessage struct {
+	ID         string
+	Data       []byte
+	Deliveries int64 // сколько раз продажа уже выдавалась, включая эту
+}
+
+// Listing — активное выставление NFT на продажу или аукцион
+type Listing struct {
+	Kind     string  `json:"kind"` // sale или auction
+	Price    float64 `json:"price"`
+	Currency string  `json:"currency"`
+	Seller   string  `json:"seller"`
+	Since    int64   `json:"since"` // время выставления, мс
+}
+
+// Offer — предложение покупателя купить NFT
+type Offer struct {
+	Buyer    string  `json:"buyer"`
+	Price    float64 `json:"price"`
+	Currency string  `json:"currency"`
+	Since    int64   `json:"since"` // время предложения или отзыва, мс
+	// Cancelled — отозвано или принято; хранится, чтобы более старое событие
+	// предложения, пришедшее позже, не вернуло его
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// sortOffers упорядочивает предложения от лучшего к худшему
+func sortOffers(offers []Offer) {
+	sort.Slice(offers, func(i, j int) bool {
+		if offers[i].Price != offers[j].Price {
+			return offers[i].Price > offers[j].Price
+		}
+		return offers[i].Buyer < offers[j].Buyer
+	})
+}
+
+// IndexEvent — событие истории, подготовленное к применению
+type IndexEvent struct {
+	ID        string  // lt:hash, по нему отсеиваются повторы
+	Type      string  // тип события getgems
+	Address   string  // адрес NFT
+	Timestamp int64   // время события, мс
+	HasPrice  bool    // mint или sold в TON: Price идёт в цену NFT и агрегаты
+	Price     float64 // цена минта или продажи в TON
+	Sale      []byte  // JSON для очереди уведомлений; nil — не публиковать
+	Resume    string  // курсор, с которого продолжить индексацию после события
+
+	// живое состояние NFT; burn дополнительно забывает владельца
+	Owner   string   // новый владелец; пусто — не менять
+	Listing *Listing // новое выставление; nil — не менять
+	Delist  bool     // снять выставление
+	Offer   *Offer   // новое предложение покупателя или его отзыв; nil — не менять
+
+	// для долговременной истории (SQLiteStore)
+	Name     string
+	Currency string
+	NewOwner string
+	OldOwner string
+	Lt       string
+	Hash     string
+}
+
+var (
+	_ Store = (*RedisStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*SQLiteStore)(nil)
+)
@@ -0,0 +1,224 @@
+package botutils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// IndexCheck — результат сверки агрегатов коллекции с ценами отдельных NFT
+type IndexCheck struct {
+	Collection  string
+	StoredCount int64    // collection:count
+	StoredSum   float64  // collection:sum
+	Count       int64    // NFT с ценой по nft:last_price:*
+	Sum         float64  // сумма этих цен
+	Indexed     int64    // NFT в ZSET цен коллекции
+	Mismatched  int      // NFT, которых нет в ZSET, лишние в нём или с другой ценой
+	Missing     []string // NFT из снимка адресов без цены
+	Unknown     []string // NFT с ценой, которых нет в снимке
+	Snapshot    int      // сколько адресов в снимке; 0 — снимок не сверялся
+	Repaired    bool
+}
+
+// Drift сообщает, что агрегаты или ZSET цен расходятся с ценами NFT
+func (c *IndexCheck) Drift() bool {
+	return c.aggregateDrift() || c.Mismatched > 0
+}
+
+func (c *IndexCheck) aggregateDrift() bool {
+	return c.StoredCount != c.Count || math.Abs(c.StoredSum-c.Sum) > 1e-6*math.Max(1, float64(c.Count))
+}
+
+// OK — агрегаты сходятся и снимок адресов совпадает с индексом
+func (c *IndexCheck) OK() bool {
+	return !c.Drift() && len(c.Missing) == 0 && len(c.Unknown) == 0
+}
+
+func (c *IndexCheck) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: count %d / по NFT %d, sum %.4f / по NFT %.4f, в ZSET цен %d (расходится %d)",
+		c.Collection, c.StoredCount, c.Count, c.StoredSum, c.Sum, c.Indexed, c.Mismatched)
+	if c.Snapshot > 0 {
+		fmt.Fprintf(&b, ", в снимке %d, без цены %d, вне снимка %d",
+			c.Snapshot, len(c.Missing), len(c.Unknown))
+	}
+	switch {
+	case c.Repaired:
+		b.WriteString(" — исправлено")
+	case c.Drift():
+		b.WriteString(" — расхождение")
+	}
+	return b.String()
+}
+
+// CheckCollectionIndex пересчитывает сумму и количество по ценам NFT коллекции в st
+// и сравнивает с сохранёнными агрегатами, ZSET цен и снимком адресов (snapshot, пустой — без снимка).
+// st — хранилище бота: с SQLiteStore цены и агрегаты берутся из SQL, а не из кэша, который Redis мог вытеснить.
+// repair — при расхождении записать пересчитанные значения и пересобрать ZSET; сверка тогда идёт под
+// блокировкой индексатора, чтобы он не менял цены между пересчётом и записью.
+func CheckCollectionIndex(ctx context.Context, rds *redis.Client, st Store, collection, snapshot string, repair bool) (*IndexCheck, error) {
+	if repair {
+		lock, err := AcquireIndexLock(ctx, rds, collection, "check@"+InstanceName())
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+		ctx = lock.Context()
+	}
+
+	check, prices, err := recountIndex(ctx, st, collection)
+	if err != nil {
+		return nil, err
+	}
+	k := liveKeys(collection)
+	if check.Indexed, check.Mismatched, err = checkPriceIndex(ctx, rds, k, prices); err != nil {
+		return nil, err
+	}
+
+	if snapshot != "" {
+		addrs, err := readAddresses(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		check.Snapshot = len(addrs)
+		inSnapshot := make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			inSnapshot[addr] = true
+			if _, ok := prices[addr]; !ok {
+				check.Missing = append(check.Missing, addr)
+			}
+		}
+		for addr := range prices {
+			if !inSnapshot[addr] {
+				check.Unknown = append(check.Unknown, addr)
+			}
+		}
+	}
+
+	if repair && check.aggregateDrift() {
+		if err := st.SetAggregate(ctx, collection, check.Sum, check.Count); err != nil {
+			return nil, err
+		}
+		check.Repaired = true
+	}
+	if repair && check.Mismatched > 0 {
+		if err := repairPriceIndex(ctx, rds, k, prices); err != nil {
+			return nil, err
+		}
+		check.Repaired = true
+	}
+	return check, nil
+}
+
+// checkPriceIndex сверяет ZSET цен коллекции с ценами NFT: возвращает его размер
+// и число NFT, которых в нём нет, лишних или с другой ценой
+func checkPriceIndex(ctx context.Context, rds *redis.Client, k indexKeys, prices map[string]float64) (int64, int, error) {
+	zs, err := rds.ZRangeWithScores(ctx, k.prices(), 0, -1).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	mismatched := 0
+	seen := make(map[string]bool, len(zs))
+	for _, z := range zs {
+		addr, _ := z.Member.(string)
+		seen[addr] = true
+		if price, ok := prices[addr]; !ok || price != z.Score {
+			mismatched++
+		}
+	}
+	for addr := range prices {
+		if !seen[addr] {
+			mismatched++
+		}
+	}
+	return int64(len(zs)), mismatched, nil
+}
+
+// repairPriceIndex собирает ZSET цен заново во временном ключе и подменяет им живой
+func repairPriceIndex(ctx context.Context, rds *redis.Client, k indexKeys, prices map[string]float64) error {
+	tmp := k.prices() + ":repair"
+	if err := rds.Del(ctx, tmp).Err(); err != nil {
+		return err
+	}
+	members := make([]*redis.Z, 0, len(prices))
+	for addr, price := range prices {
+		members = append(members, &redis.Z{Score: price, Member: addr})
+	}
+	const batch = 500
+	for start := 0; start < len(members); start += batch {
+		end := start + batch
+		if end > len(members) {
+			end = len(members)
+		}
+		if err := rds.ZAdd(ctx, tmp, members[start:end]...).Err(); err != nil {
+			return err
+		}
+	}
+	if len(members) == 0 {
+		return rds.Del(ctx, k.prices()).Err()
+	}
+	return rds.Rename(ctx, tmp, k.prices()).Err()
+}
+
+// recountIndex пересчитывает сумму и количество по ценам NFT и читает сохранённые агрегаты
+func recountIndex(ctx context.Context, st Store, collection string) (*IndexCheck, map[string]float64, error) {
+	prices, err := st.NftPrices(ctx, collection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	check := &IndexCheck{Collection: collection, Count: int64(len(prices))}
+	for _, p := range prices {
+		check.Sum += p
+	}
+	if check.StoredSum, check.StoredCount, err = st.Aggregate(ctx, collection); err != nil {
+		return nil, nil, err
+	}
+	return check, prices, nil
+}
+
+// CheckIndexPeriodically сверяет индекс коллекции раз в interval и пишет итог в лог
+func CheckIndexPeriodically(rds *redis.Client, st Store, p *Product, interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(Ctx, indexLockTTL)
+		check, err := CheckCollectionIndex(ctx, rds, st, p.FragmentCollection, p.AddressesFile, repair)
+		cancel()
+		if err != nil {
+			log.Printf("[Check] %s: %v", p.ID, err)
+			continue
+		}
+		if check.OK() {
+			log.Printf("[Check] ✅ %s", check)
+		} else {
+			log.Printf("[Check] ⚠️ %s", check)
+		}
+	}
+}
+
+// readAddresses читает снимок адресов NFT: по одному адресу в строке
+func readAddresses(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if addr := strings.TrimSpace(sc.Text()); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, sc.Err()
+}
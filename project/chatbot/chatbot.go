@@ -25,11 +25,12 @@ type CommandInfo struct {
 type SimpleBot struct {
 	Name        string
 	RedisClient *redis.Client
+	Store       botutils.Store
 }
 
 // --- Создание SimpleBot ---
 func NewSimpleBot(name string, redisClient *redis.Client) *SimpleBot {
-	return &SimpleBot{Name: name, RedisClient: redisClient}
+	return &SimpleBot{Name: name, RedisClient: redisClient, Store: botutils.NewRedisStore(redisClient)}
 }
 
 // --- Реестр команд ---
@@ -86,18 +87,21 @@ func OnTextGlobalHandler(bot *telebot.Bot, redisClient *redis.Client, cb *Simple
 // --- Инициализация команд ---
 func InitCommands(bot *SimpleBot) {
 	rc := bot.RedisClient
+	st := bot.Store
 
 	RegisterCommand("/look", WrapHandlerWithError(func(c telebot.Context) error {
 		return botutils.HandleLook(c)
 	}),"")
 
 	RegisterCommand("/floor", WrapHandlerWithError(func(c telebot.Context) error {
-		return botutils.HandleFloor(c.Bot(), rc, c)
+		return botutils.HandleFloor(c.Bot(), st, c)
 	}), "сводка")
 
 	RegisterCommand("/ps", WrapHandlerWithError(func(c telebot.Context) error {
-		return botutils.HandlePS(rc, c)
+		return botutils.HandlePS(rc, st, c)
 	}), "")
 
-	RegisterCommand("/address", WrapHandlerWithError(botutils.HandleMeSingleLine(rc)), "Профиль")
+	RegisterCommand("/address", WrapHandlerWithError(botutils.HandleMeSingleLine(st)), "Профиль")
+
+	RegisterCommand("/wipe", WrapHandlerWithError(botutils.HandleWipe(rc)), "")
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	apiqueue "tg-getgems-bot/api"
+	"tg-getgems-bot/botutils"
+	"tg-getgems-bot/getgems"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// cliUsage — список служебных команд
+const cliUsage = `использование:
+  rebuild [-force] [продукт|all] пересобрать индекс коллекции фрагментов и подменить живой
+  check [-repair] [продукт|all]  сверить агрегаты индекса с ценами NFT и снимком адресов
+  wipe продукт|all               удалить индекс коллекции, чтобы собрать его заново
+  snapshot [продукт|all]         сохранить адреса NFT коллекции фрагментов из tonapi в снимок для check
+  ohlc [-res 1h|1d|1w] [-from ГГГГ-ММ-ДД] [-to ГГГГ-ММ-ДД] [продукт]
+                                 выгрузить свечи продаж в CSV (по умолчанию 1d за 30 дней)`
+
+// recoveryCommands — команды, которые выполняются до миграций схемы
+var recoveryCommands = map[string]bool{"rebuild": true, "wipe": true}
+
+// runCLI выполняет служебную команду вместо запуска бота
+func runCLI(rdb *redis.Client, args []string) error {
+	st, closeStore, err := openStore(rdb)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	switch args[0] {
+	case "rebuild":
+		fs := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+		force := fs.Bool("force", false, "подменить, даже если число NFT расходится с живым индексом или API")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		products, err := selectProducts(fs.Args())
+		if err != nil {
+			return err
+		}
+		for _, p := range products {
+			report, err := botutils.RebuildCollectionIndex(botutils.Ctx, rdb, p.FragmentCollection, *force)
+			if err != nil {
+				return fmt.Errorf("пересборка %s: %w", p.ID, err)
+			}
+			log.Printf("✅ %s", report)
+		}
+		return nil
+	case "check":
+		fs := flag.NewFlagSet("check", flag.ContinueOnError)
+		repair := fs.Bool("repair", false, "исправить расхождение агрегатов")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		products, err := selectProducts(fs.Args())
+		if err != nil {
+			return err
+		}
+		drift := false
+		for _, p := range products {
+			check, err := botutils.CheckCollectionIndex(botutils.Ctx, rdb, st, p.FragmentCollection, p.AddressesFile, *repair)
+			if err != nil {
+				return fmt.Errorf("сверка %s: %w", p.ID, err)
+			}
+			log.Printf("%s", check)
+			for _, addr := range check.Missing {
+				log.Printf("  без цены: %s", addr)
+			}
+			for _, addr := range check.Unknown {
+				log.Printf("  вне снимка: %s", addr)
+			}
+			if !check.OK() && !check.Repaired {
+				drift = true
+			}
+		}
+		if drift {
+			return fmt.Errorf("индекс расходится с ценами NFT")
+		}
+		return nil
+	case "wipe":
+		if len(args) < 2 {
+			return fmt.Errorf("укажите коллекцию явно\n%s", cliUsage)
+		}
+		products, err := selectProducts(args[1:])
+		if err != nil {
+			return err
+		}
+		for _, p := range products {
+			if err := botutils.WipeCollection(botutils.Ctx, rdb, p.FragmentCollection); err != nil {
+				return fmt.Errorf("удаление %s: %w", p.ID, err)
+			}
+			log.Printf("🗑 %s: индекс удалён", p.ID)
+		}
+		return nil
+	case "snapshot":
+		products, err := selectProducts(args[1:])
+		if err != nil {
+			return err
+		}
+		for _, p := range products {
+			n, err := writeAddressSnapshot(p)
+			if err != nil {
+				return fmt.Errorf("снимок %s: %w", p.ID, err)
+			}
+			log.Printf("📁 %s: %d адресов сохранено в %s", p.ID, n, p.AddressesFile)
+		}
+		return nil
+	case "ohlc":
+		return exportOHLC(st, args[1:])
+	default:
+		return fmt.Errorf("неизвестная команда %q\n%s", args[0], cliUsage)
+	}
+}
+
+// openStore открывает хранилище, как у бота: с SQLITE_PATH свечи, агрегаты и цены
+// читаются из SQLite, а Redis остаётся кэшем перед ней
+func openStore(rdb *redis.Client) (botutils.Store, func(), error) {
+	cache := botutils.NewRedisStore(rdb)
+	path := os.Getenv("SQLITE_PATH")
+	if path == "" {
+		return cache, func() {}, nil
+	}
+	st, err := botutils.OpenSQLiteStore(path, cache)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SQLite: %w", err)
+	}
+	return st, func() { st.Close() }, nil
+}
+
+// writeAddressSnapshot выгружает адреса всех NFT коллекции фрагментов из tonapi
+// в p.AddressesFile, по одному в строке. Файл подменяется целиком, только если выгрузка удалась.
+func writeAddressSnapshot(p *botutils.Product) (int, error) {
+	if p.AddressesFile == "" {
+		return 0, fmt.Errorf("у продукта не задан addressesFile")
+	}
+
+	var addrs []string
+	ctx := getgems.WithPriority(botutils.Ctx, apiqueue.Backfill)
+	pages := getgems.TonCollectionPages(apiqueue.Queue, p.FragmentCollection, 1000)
+	for pages.Next(ctx) {
+		for _, item := range pages.Page() {
+			addr, err := item.FriendlyAddress()
+			if err != nil {
+				log.Println("⚠️ Ошибка конвертации адреса:", item.Address, err)
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		log.Printf("📦 Страница %d: загружено %d NFT (всего %d)", pages.Pages(), len(pages.Page()), len(addrs))
+	}
+	if err := pages.Err(); err != nil {
+		return 0, err
+	}
+	if len(addrs) == 0 {
+		return 0, fmt.Errorf("tonapi не вернул ни одной NFT")
+	}
+
+	tmp := p.AddressesFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(addrs, "\n")+"\n"), 0o644); err != nil {
+		return 0, err
+	}
+	return len(addrs), os.Rename(tmp, p.AddressesFile)
+}
+
+// exportOHLC пишет свечи продаж коллекции в stdout в формате CSV
+func exportOHLC(st botutils.Store, args []string) error {
+	fs := flag.NewFlagSet("ohlc", flag.ContinueOnError)
+	res := fs.String("res", botutils.Resolution1d, "разрешение свечей: 1h, 1d или 1w")
+	fromFlag := fs.String("from", "", "начало диапазона, ГГГГ-ММ-ДД (UTC)")
+	toFlag := fs.String("to", "", "конец диапазона не включительно, ГГГГ-ММ-ДД (UTC)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	products, err := selectProducts(fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(products) != 1 {
+		return fmt.Errorf("выгрузка — по одной коллекции")
+	}
+
+	to := time.Now().UTC()
+	if *toFlag != "" {
+		if to, err = time.Parse("2006-01-02", *toFlag); err != nil {
+			return err
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if *fromFlag != "" {
+		if from, err = time.Parse("2006-01-02", *fromFlag); err != nil {
+			return err
+		}
+	}
+
+	candles, err := botutils.GetOHLC(st, products[0].FragmentCollection, *res, from, to)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"start", "open", "high", "low", "close", "volume", "trades"})
+	for _, c := range candles {
+		w.Write([]string{
+			time.UnixMilli(c.Start).UTC().Format(time.RFC3339),
+			strconv.FormatFloat(c.Open, 'f', -1, 64),
+			strconv.FormatFloat(c.High, 'f', -1, 64),
+			strconv.FormatFloat(c.Low, 'f', -1, 64),
+			strconv.FormatFloat(c.Close, 'f', -1, 64),
+			strconv.FormatFloat(c.Volume, 'f', -1, 64),
+			strconv.FormatInt(c.Trades, 10),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// selectProducts — продукт по селектору, все продукты для "all", по умолчанию — основной
+func selectProducts(args []string) ([]*botutils.Product, error) {
+	if len(args) > 0 && args[0] == "all" {
+		return botutils.Products(), nil
+	}
+	selector := ""
+	if len(args) > 0 {
+		selector = args[0]
+	}
+	p, ok := botutils.ProductBySelector(selector)
+	if !ok {
+		return nil, fmt.Errorf("неизвестная коллекция %q", selector)
+	}
+	return []*botutils.Product{p}, nil
+}
@@ -1,14 +1,13 @@
-package botutils
+package getgems
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 
-	"github.com/joho/godotenv"
 	"github.com/xssnick/tonutils-go/address"
 )
 
@@ -16,99 +15,67 @@ type TonNftItem struct {
 	Address string `json:"address"` // raw формат: 0:HEX
 }
 
+// FriendlyAddress — адрес NFT в пользовательском формате (EQ...), как его отдаёт getgems
+func (item TonNftItem) FriendlyAddress() (string, error) {
+	addr, err := address.ParseRawAddr(item.Address)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
 type TonCollectionResponse struct {
 	NFTs  []TonNftItem `json:"nft_items"`
 	Total int          `json:"total"`
 }
 
-func getTonCollectionNFTs(collectionAddr string) ([]string, error) {
-	var all []string
-	offset := 0
-	limit := 1000
-
-	for {
-		url := fmt.Sprintf(
-			"https://tonapi.io/v2/nfts/collections/%s/items?limit=%d&offset=%d",
-			collectionAddr, limit, offset,
-		)
-
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return nil, err
-		}
-
-		if token := os.Getenv("TONAPI_TOKEN"); token != "" {
-			req.Header.Set("Authorization", "Bearer "+token)
-		}
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("status %s: %s", resp.Status, string(body))
-		}
+// TonHost — хост tonapi: по нему настраиваются лимиты очереди
+const TonHost = "tonapi.io"
 
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
+// tonCollectionPage загружает одну страницу NFT коллекции из tonapi через очередь
+func tonCollectionPage(ctx context.Context, queue Queue, collectionAddr string, offset, limit int) ([]TonNftItem, error) {
+	url := fmt.Sprintf(
+		"https://%s/v2/nfts/collections/%s/items?limit=%d&offset=%d",
+		TonHost, collectionAddr, limit, offset,
+	)
 
-		var res TonCollectionResponse
-		if err := json.Unmarshal(bodyBytes, &res); err != nil {
-			return nil, err
-		}
-
-		for _, item := range res.NFTs {
-			addr, err := address.ParseRawAddr(item.Address)
-			if err != nil {
-				log.Println("⚠️ Ошибка конвертации адреса:", item.Address, err)
-				continue
-			}
-			all = append(all, addr.String())
-		}
-
-		log.Printf("📦 Offset %d: загружено %d NFT (всего %d)", offset, len(res.NFTs), len(all))
-
-		if len(res.NFTs) < limit {
-			break
-		}
-		offset += limit
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return all, nil
-}
-
-func mainaddr() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("⚠️ .env файл не найден, используем переменные окружения")
+	if token := os.Getenv("TONAPI_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	collection := "EQAnmo8tBH8gSErzWDrdlJiF8kxgfJEynKMIBxL2MkuHvPBc"
-	nfts, err := getTonCollectionNFTs(collection)
+	resp, err := queue.EnqueueContext(ctx, req, priorityFrom(ctx))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	fmt.Printf("✅ Всего NFT: %d\n", len(nfts))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %s: %s", resp.Status, string(body))
+	}
 
-	// Открываем файл для записи
-	file, err := os.Create("nft_addresses.txt")
+	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer file.Close()
 
-	// Записываем каждый адрес в файл
-	for _, addr := range nfts {
-	_, err := file.WriteString(addr + "\n")
-	if err != nil {
-		log.Fatal(err)
+	var res TonCollectionResponse
+	if err := json.Unmarshal(bodyBytes, &res); err != nil {
+		return nil, err
 	}
+	return res.NFTs, nil
 }
-	fmt.Println("📁 Адреса сохранены в nft_addresses.txt")
+
+// TonCollectionPages обходит NFT коллекции в tonapi страницами по limit/offset.
+// Запросы идут через queue с приоритетом из контекста (WithPriority).
+func TonCollectionPages(queue Queue, collectionAddr string, limit int) *Iterator[TonNftItem] {
+	fetch := OffsetPages(1000, func(ctx context.Context, offset, limit int) ([]TonNftItem, error) {
+		return tonCollectionPage(ctx, queue, collectionAddr, offset, limit)
+	})
+	return NewIterator(fetch).PageSize(limit)
 }
@@ -0,0 +1,69 @@
+package getgems
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	apiqueue "tg-getgems-bot/api"
+)
+
+// recordQueue выполняет запросы обработчиком напрямую и запоминает их
+type recordQueue struct {
+	handler  http.Handler
+	requests []*http.Request
+}
+
+func (q *recordQueue) EnqueueContext(ctx context.Context, req *http.Request, priority apiqueue.RequestPriority) (*http.Response, error) {
+	q.requests = append(q.requests, req)
+	rec := httptest.NewRecorder()
+	q.handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func TestTonCollectionPages(t *testing.T) {
+	var items []TonNftItem
+	for i := 0; i < 3; i++ {
+		items = append(items, TonNftItem{Address: fmt.Sprintf("0:%064x", i+1)})
+	}
+	q := &recordQueue{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := min(offset+limit, len(items))
+		json.NewEncoder(w).Encode(TonCollectionResponse{NFTs: items[offset:end], Total: len(items)})
+	})}
+
+	var got []string
+	pages := TonCollectionPages(q, "EQcollection", 2)
+	for pages.Next(context.Background()) {
+		for _, item := range pages.Page() {
+			addr, err := item.FriendlyAddress()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, addr)
+		}
+	}
+	if err := pages.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 || pages.Pages() != 2 {
+		t.Fatalf("адресов %d за %d страниц, ожидалось 3 за 2", len(got), pages.Pages())
+	}
+	for _, addr := range got {
+		if len(addr) != 48 || !strings.HasPrefix(addr, "EQ") {
+			t.Errorf("адрес %q не в пользовательском формате", addr)
+		}
+	}
+	for i, req := range q.requests {
+		if req.URL.Host != TonHost || req.URL.Query().Get("offset") != strconv.Itoa(2*i) {
+			t.Errorf("запрос %d: %s", i, req.URL)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package getgems
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	apiqueue "tg-getgems-bot/api"
+)
+
+// Host — хост getgems API: по нему настраиваются лимиты и breaker очереди
+const Host = "api.getgems.io"
+
+// DefaultBaseURL — базовый адрес публичного API getgems
+const DefaultBaseURL = "https://" + Host + "/public-api/v1"
+
+// Queue — очередь, через которую идут все запросы (apiqueue.ApiQueue)
+type Queue interface {
+	EnqueueContext(ctx context.Context, req *http.Request, priority apiqueue.RequestPriority) (*http.Response, error)
+}
+
+// StatusError — getgems ответил не 200
+type StatusError struct {
+	Endpoint   string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("getgems %s: статус %d: %s", e.Endpoint, e.StatusCode, e.Body)
+}
+
+// UnsuccessfulError — getgems ответил 200, но с success=false
+type UnsuccessfulError struct {
+	Endpoint string
+	Body     string
+}
+
+func (e *UnsuccessfulError) Error() string {
+	return fmt.Sprintf("getgems %s: success=false: %s", e.Endpoint, e.Body)
+}
+
+// Client — типизированный клиент getgems API поверх очереди запросов
+type Client struct {
+	baseURL string
+	token   string
+	queue   Queue
+}
+
+// NewClient создаёт клиент; token уходит в заголовок Authorization, если не пустой
+func NewClient(queue Queue, token string) *Client {
+	return &Client{baseURL: DefaultBaseURL, token: token, queue: queue}
+}
+
+type priorityKey struct{}
+
+// WithPriority задаёт класс приоритета очереди для запросов с этим контекстом.
+// По умолчанию запросы клиента идут как apiqueue.Interactive.
+func WithPriority(ctx context.Context, p apiqueue.RequestPriority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) apiqueue.RequestPriority {
+	if p, ok := ctx.Value(priorityKey{}).(apiqueue.RequestPriority); ok {
+		return p
+	}
+	return apiqueue.Interactive
+}
+
+// get выполняет GET, разбирает конверт и кладёт response в out
+func get[T any](ctx context.Context, c *Client, endpoint string, query url.Values) (*T, error) {
+	u := c.baseURL + endpoint
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("accept", "application/json")
+	if c.token != "" {
+		req.Header.Add("Authorization", c.token)
+	}
+
+	resp, err := c.queue.EnqueueContext(ctx, req, priorityFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Endpoint: endpoint, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var env envelope[T]
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("getgems %s: %w", endpoint, err)
+	}
+	if !env.Success {
+		return nil, &UnsuccessfulError{Endpoint: endpoint, Body: string(body)}
+	}
+	return &env.Response, nil
+}
+
+// CollectionStats возвращает статистику коллекции (флор, холдеры, объём)
+func (c *Client) CollectionStats(ctx context.Context, collection string) (*CollectionStats, error) {
+	return get[CollectionStats](ctx, c, "/collection/stats/"+collection, nil)
+}
+
+// CollectionAttributes возвращает трейты коллекции с минимальными ценами
+func (c *Client) CollectionAttributes(ctx context.Context, collection string) ([]Attribute, error) {
+	res, err := get[struct {
+		Attributes []Attribute `json:"attributes"`
+	}](ctx, c, "/collection/attributes/"+collection, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Attributes, nil
+}
+
+// OnSale возвращает страницу offchain NFT коллекции, выставленных на продажу
+func (c *Client) OnSale(ctx context.Context, collection string, limit int, after string) (*NftPage, error) {
+	return get[NftPage](ctx, c, "/nfts/offchain/on-sale/"+collection, pageQuery(limit, after))
+}
+
+// OwnerNfts возвращает страницу NFT коллекции у владельца
+func (c *Client) OwnerNfts(ctx context.Context, collection, owner string, limit int, after string) (*NftPage, error) {
+	return get[NftPage](ctx, c, "/nfts/collection/"+collection+"/owner/"+owner, pageQuery(limit, after))
+}
+
+// HistoryQuery — фильтры истории коллекции или NFT
+type HistoryQuery struct {
+	Types   []string
+	Limit   int
+	After   string
+	Reverse bool
+}
+
+func (q HistoryQuery) values() url.Values {
+	v := pageQuery(q.Limit, q.After)
+	if q.Reverse {
+		v.Set("reverse", "true")
+	}
+	for _, t := range q.Types {
+		v.Add("types", t)
+	}
+	return v
+}
+
+// CollectionHistory возвращает страницу истории коллекции
+func (c *Client) CollectionHistory(ctx context.Context, collection string, q HistoryQuery) (*HistoryPage, error) {
+	return get[HistoryPage](ctx, c, "/collection/history/"+collection, q.values())
+}
+
+// NftHistory возвращает страницу истории одной NFT
+func (c *Client) NftHistory(ctx context.Context, nft string, q HistoryQuery) (*HistoryPage, error) {
+	return get[HistoryPage](ctx, c, "/nft/history/"+nft, q.values())
+}
+
+func pageQuery(limit int, after string) url.Values {
+	v := url.Values{}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	if after != "" {
+		v.Set("after", after)
+	}
+	return v
+}
@@ -0,0 +1,176 @@
+package getgems
+
+import (
+	"context"
+	"strconv"
+)
+
+// PageFunc загружает до limit элементов после cursor и возвращает их вместе
+// с курсором следующей страницы; пустой курсор означает конец списка
+type PageFunc[T any] func(ctx context.Context, cursor string, limit int) ([]T, string, error)
+
+// Iterator обходит постраничный список по курсору:
+//
+//	it := client.CollectionHistoryPages(addr, q).Resume(saved)
+//	for it.Next(ctx) { for _, item := range it.Page() { ... }; save(it.Cursor()) }
+//	if err := it.Err(); err != nil { ... }
+//
+// Курсор после каждой страницы можно сохранить и потом продолжить с него через Resume.
+type Iterator[T any] struct {
+	fetch  PageFunc[T]
+	cursor string
+	limit  int
+	page   []T
+	pages  int
+	err    error
+	done   bool
+}
+
+// NewIterator создаёт итератор поверх произвольной функции загрузки страницы
+func NewIterator[T any](fetch PageFunc[T]) *Iterator[T] {
+	return &Iterator[T]{fetch: fetch}
+}
+
+// Resume продолжает обход с сохранённого курсора
+func (it *Iterator[T]) Resume(cursor string) *Iterator[T] {
+	it.cursor = cursor
+	return it
+}
+
+// PageSize задаёт размер страницы; 0 — размер по умолчанию у API
+func (it *Iterator[T]) PageSize(limit int) *Iterator[T] {
+	it.limit = limit
+	return it
+}
+
+// Stop завершает обход досрочно: следующий Next вернёт false
+func (it *Iterator[T]) Stop() {
+	it.done = true
+}
+
+// Next загружает следующую страницу; false — страниц больше нет, обход остановлен или произошла ошибка
+func (it *Iterator[T]) Next(ctx context.Context) bool {
+	if it.done {
+		return false
+	}
+	items, next, err := it.fetch(ctx, it.cursor, it.limit)
+	if err != nil {
+		it.err = err
+		it.done = true
+		return false
+	}
+	it.page = items
+	it.pages++
+	if next == "" || len(items) == 0 {
+		it.done = true
+	}
+	// курсор не затираем пустым, чтобы Resume с него повторил только хвост
+	if next != "" {
+		it.cursor = next
+	}
+	return len(items) > 0
+}
+
+// Page возвращает элементы текущей страницы
+func (it *Iterator[T]) Page() []T {
+	return it.page
+}
+
+// Cursor возвращает курсор, с которого продолжится обход
+func (it *Iterator[T]) Cursor() string {
+	return it.cursor
+}
+
+// Done сообщает, что список пройден до конца (или обход остановлен)
+func (it *Iterator[T]) Done() bool {
+	return it.done
+}
+
+// Pages возвращает число загруженных страниц
+func (it *Iterator[T]) Pages() int {
+	return it.pages
+}
+
+// Err возвращает ошибку, на которой остановился обход
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// ForEach вызывает fn для каждого элемента; fn возвращает false, чтобы остановить обход
+func (it *Iterator[T]) ForEach(ctx context.Context, fn func(T) bool) error {
+	for it.Next(ctx) {
+		for _, item := range it.Page() {
+			if !fn(item) {
+				it.Stop()
+				return nil
+			}
+		}
+	}
+	return it.Err()
+}
+
+// OffsetPages превращает API с limit/offset (tonapi) в PageFunc:
+// курсор — это смещение, конец списка — неполная страница
+func OffsetPages[T any](defaultLimit int, fetch func(ctx context.Context, offset, limit int) ([]T, error)) PageFunc[T] {
+	return func(ctx context.Context, cursor string, limit int) ([]T, string, error) {
+		if limit <= 0 {
+			limit = defaultLimit
+		}
+		offset := 0
+		if cursor != "" {
+			var err error
+			if offset, err = strconv.Atoi(cursor); err != nil {
+				return nil, "", err
+			}
+		}
+
+		items, err := fetch(ctx, offset, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(items) < limit {
+			return items, "", nil
+		}
+		return items, strconv.Itoa(offset + len(items)), nil
+	}
+}
+
+// CollectionHistoryPages обходит историю коллекции, начиная с q.After
+func (c *Client) CollectionHistoryPages(collection string, q HistoryQuery) *Iterator[HistoryItem] {
+	it := NewIterator(func(ctx context.Context, cursor string, limit int) ([]HistoryItem, string, error) {
+		q.After = cursor
+		if limit > 0 {
+			q.Limit = limit
+		}
+		page, err := c.CollectionHistory(ctx, collection, q)
+		if err != nil {
+			return nil, "", err
+		}
+		return page.Items, page.Cursor, nil
+	})
+	return it.Resume(q.After).PageSize(q.Limit)
+}
+
+// OwnerNftPages обходит NFT коллекции у владельца
+func (c *Client) OwnerNftPages(collection, owner string, limit int) *Iterator[NftItem] {
+	it := NewIterator(func(ctx context.Context, cursor string, limit int) ([]NftItem, string, error) {
+		page, err := c.OwnerNfts(ctx, collection, owner, limit, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		return page.Items, page.Cursor, nil
+	})
+	return it.PageSize(limit)
+}
+
+// OnSalePages обходит NFT коллекции, выставленные на продажу
+func (c *Client) OnSalePages(collection string, limit int) *Iterator[NftItem] {
+	it := NewIterator(func(ctx context.Context, cursor string, limit int) ([]NftItem, string, error) {
+		page, err := c.OnSale(ctx, collection, limit, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		return page.Items, page.Cursor, nil
+	})
+	return it.PageSize(limit)
+}
@@ -0,0 +1,92 @@
+package getgems
+
+// envelope — общий конверт ответа getgems: {"success": ..., "response": ...}
+type envelope[T any] struct {
+	Success  bool `json:"success"`
+	Response T    `json:"response"`
+}
+
+// Типы событий истории
+const (
+	TypeMint            = "mint"
+	TypeSold            = "sold"
+	TypeTransfer        = "transfer"
+	TypePutUpForSale    = "putUpForSale"
+	TypeCancelSale      = "cancelSale"
+	TypePutUpForAuction = "putUpForAuction"
+	TypeCancelAuction   = "cancelAuction"
+	TypeBurn            = "burn"
+	TypeOffer           = "offer"
+	TypeCancelOffer     = "cancelOffer"
+)
+
+// CollectionStats — ответ /collection/stats
+type CollectionStats struct {
+	FloorPrice          float64 `json:"floorPrice"`
+	FloorPriceNano      string  `json:"floorPriceNano"` // в JSON это строка
+	ItemsCount          int     `json:"itemsCount"`
+	TotalVolumeSold     string  `json:"totalVolumeSold"`
+	TotalVolumeSoldNano string  `json:"totalVolumeSoldNano"`
+	Holders             int     `json:"holders"`
+}
+
+// Attribute — трейт коллекции из /collection/attributes
+type Attribute struct {
+	TraitType string           `json:"traitType"`
+	Values    []AttributeValue `json:"values"`
+}
+
+type AttributeValue struct {
+	Value        string `json:"value"`
+	Count        int    `json:"count"`
+	MinPrice     string `json:"minPrice"`
+	MinPriceNano string `json:"minPriceNano"`
+}
+
+// Sale — условия продажи NFT
+type Sale struct {
+	FullPrice string `json:"fullPrice"` // в нанотонах
+}
+
+// NftItem — NFT из списков on-sale и owner
+type NftItem struct {
+	Address           string `json:"address"`
+	CollectionAddress string `json:"collectionAddress"`
+	Name              string `json:"name"`
+	Sale              *Sale  `json:"sale"`
+}
+
+// NftPage — страница списка NFT; null в cursor превращается в пустую строку
+type NftPage struct {
+	Cursor string    `json:"cursor"`
+	Items  []NftItem `json:"items"`
+}
+
+// HistoryItem — событие истории коллекции или NFT
+type HistoryItem struct {
+	Address           string   `json:"address"`
+	Name              string   `json:"name"`
+	Time              string   `json:"time"`
+	Timestamp         int64    `json:"timestamp"`
+	CollectionAddress string   `json:"collectionAddress"`
+	Lt                string   `json:"lt"`
+	Hash              string   `json:"hash"`
+	IsOffchain        bool     `json:"isOffchain"`
+	TypeData          TypeData `json:"typeData"`
+}
+
+type TypeData struct {
+	Type                string `json:"type"`
+	Price               string `json:"price"`     // "1.4"
+	PriceNano           string `json:"priceNano"` // "1400000000"
+	NewOwner            string `json:"newOwner"`
+	OldOwner            string `json:"oldOwner"`
+	RejectFromGlobalTop bool   `json:"rejectFromGlobalTop"`
+	Currency            string `json:"currency"` // "TON"
+}
+
+// HistoryPage — страница истории
+type HistoryPage struct {
+	Cursor string        `json:"cursor"`
+	Items  []HistoryItem `json:"items"`
+}
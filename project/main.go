@@ -7,6 +7,7 @@ import (
 	apiqueue "tg-getgems-bot/api"
 	"tg-getgems-bot/botutils"
 	"tg-getgems-bot/chatbot"
+	"tg-getgems-bot/getgems"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -49,7 +50,7 @@ type AttrValues struct {
 }
 
 // ------------------ запуск бота ------------------
-func startCollectionIndexer(rdb *redis.Client, collection string) {
+func startCollectionIndexer(rdb *redis.Client, st botutils.Store, collection string) {
 	const updateInterval = 1 * time.Minute
 	ctx := botutils.Ctx
 	ticker := time.NewTicker(updateInterval)
@@ -58,37 +59,41 @@ func startCollectionIndexer(rdb *redis.Client, collection string) {
 	firstRun := true
 
 	for {
-		// Redis lock, чтобы один индексатор на коллекцию
-		lockKey := "lock:collection_index:" + collection
-		ok, err := rdb.SetNX(ctx, lockKey, 1, 5*time.Minute).Result()
+		// Redis lock, чтобы один индексатор на коллекцию; пока идёт работа, он продлевается
+		lock, err := botutils.TryIndexLock(ctx, rdb, collection, botutils.InstanceName())
 		if err != nil {
 			log.Println("❌ Redis lock error:", err)
 			<-ticker.C
 			continue
 		}
-		if !ok {
+		if lock == nil {
 			// Кто-то другой уже индексирует
 			<-ticker.C
 			continue
 		}
+		log.Printf("👑 Индексатор коллекции %s: лидер, токен %d", collection, lock.Token)
 
-		// Логируем первый прогон
+		// Логируем первый прогон; флаг indexed не трогаем — собранный индекс остаётся доступным
 		if firstRun {
 			log.Printf("🚀 Первичный прогон индексации коллекции %s...", collection)
 			firstRun = false
-			rdb.Set(ctx, "collection:"+collection+":indexed", "false", 0)
 		}
 
 		// Запускаем UpdateCollectionIndex
-		err = botutils.UpdateCollectionIndex(rdb, collection)
+		more, err := botutils.UpdateCollectionIndex(lock.Context(), st, collection)
 		if err != nil {
 			log.Println("❌ indexer error:", err)
 		}
 
-		// Освобождаем lock
-		rdb.Del(ctx, lockKey)
+		// Освобождаем lock, если он ещё наш
+		lock.Release()
 
-		// Ждём интервал
+		// Первичный проход не закончен — следующая порция после короткой паузы,
+		// чтобы ожидающие блокировку не голодали; иначе ждём интервал
+		if more && err == nil {
+			time.Sleep(botutils.IndexLockHandoff)
+			continue
+		}
 		<-ticker.C
 	}
 }
@@ -100,15 +105,6 @@ func main() {
 		log.Println("⚠️ .env файл не найден, используем переменные окружения")
 	}
 
-	pref := telebot.Settings{
-		Token:  os.Getenv("TELEGRAM_TOKEN"),
-		Poller: &telebot.LongPoller{Timeout: 10 * time.Second},
-	}
-	bot, err := telebot.NewBot(pref)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	// Redis
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
@@ -118,71 +114,142 @@ func main() {
 	redisDB := 0
 	redisClient := botutils.NewRedisClient(redisAddr, redisPassword, redisDB)
 
+	// Инициализация очереди API: у каждого хоста свой лимит
+	apiqueue.InitPriorityQueue(100, 1200*time.Millisecond)
+	apiqueue.Queue.SetHostLimit(getgems.Host, apiqueue.HostLimit{Interval: 1200 * time.Millisecond, Burst: 1})
+	apiqueue.Queue.SetHostLimit("api.coinpaprika.com", apiqueue.HostLimit{Interval: time.Second, Burst: 5})
+	apiqueue.Queue.SetHostLimit(getgems.TonHost, apiqueue.HostLimit{Interval: time.Second, Burst: 1})
+
+	// Общий лимит на все реплики бота через Redis
+	if os.Getenv("SHARED_RATE_LIMIT") == "true" {
+		apiqueue.Queue.SetSharedLimiter(apiqueue.NewRedisLimiter(redisClient, "ratelimit:"))
+		log.Println("Общий лимит запросов через Redis включён")
+	}
+
+	// Отслеживаемые продукты: PRODUCTS_FILE или конфигурация по умолчанию
+	if err := botutils.LoadProducts(os.Getenv("PRODUCTS_FILE")); err != nil {
+		log.Fatal("❌ Ошибка загрузки продуктов: ", err)
+	}
+
+	// Команды восстановления индекса не ждут миграций: они и нужны, когда что-то сломалось
+	if len(os.Args) > 1 && recoveryCommands[os.Args[1]] {
+		if err := runCLI(redisClient, os.Args[1:]); err != nil {
+			log.Fatal("❌ ", err)
+		}
+		return
+	}
+
+	// Схема ключей: данные сохраняются между перезапусками, раскладка обновляется миграциями
+	if err := botutils.Migrate(botutils.Ctx, redisClient); err != nil {
+		log.Fatal("❌ Ошибка миграции Redis: ", err)
+	}
+
+	// Служебные команды (check, ohlc и т.п.) выполняются без запуска бота
+	if len(os.Args) > 1 {
+		if err := runCLI(redisClient, os.Args[1:]); err != nil {
+			log.Fatal("❌ ", err)
+		}
+		return
+	}
+
+	pref := telebot.Settings{
+		Token:  os.Getenv("TELEGRAM_TOKEN"),
+		Poller: &telebot.LongPoller{Timeout: 10 * time.Second},
+	}
+	bot, err := telebot.NewBot(pref)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cb := chatbot.NewSimpleBot("MyBot", redisClient)
 
+	// История событий в SQLite: Redis остаётся кэшем перед ней
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		sqliteStore, err := botutils.OpenSQLiteStore(path, cb.Store)
+		if err != nil {
+			log.Fatal("❌ Ошибка открытия SQLite: ", err)
+		}
+		defer sqliteStore.Close()
+		cb.Store = sqliteStore
+		log.Printf("История событий сохраняется в %s", path)
+	}
+
 	// --- Инициализация команд ---
 	chatbot.InitCommands(cb)
 
 	// --- Глобальный текстовый обработчик ---
 	bot.Handle(telebot.OnText, chatbot.OnTextGlobalHandler(bot, cb.RedisClient, cb))
 
-	// Очистка Redis для теста (необязательно в продакшене)
-	cb.RedisClient.FlushAll(botutils.Ctx)
+	// Для каждой коллекции — свой индексатор, уведомления и сводка
+	for _, product := range botutils.Products() {
+		collection := product.FragmentCollection
+		go startCollectionIndexer(cb.RedisClient, cb.Store, collection)
+		go botutils.ReindexWhenRequested(cb.RedisClient, collection)
+		go botutils.NotifyNewSales(bot, cb.Store, collection)
+		go postFloorPeriodically(bot, cb.Store, product)
+	}
 
-	// Инициализация очереди API
-	apiqueue.InitPriorityQueue(100, 100, 1200*time.Millisecond)
+	// Снимки флора для изменения за 24ч/7д: FLOOR_SAMPLE_INTERVAL, по умолчанию 15m
+	sampleInterval := botutils.DefaultFloorSampleInterval
+	if interval, err := time.ParseDuration(os.Getenv("FLOOR_SAMPLE_INTERVAL")); err == nil && interval > 0 {
+		sampleInterval = interval
+	}
+	for _, product := range botutils.Products() {
+		go botutils.SampleFloorPeriodically(cb.Store, product, sampleInterval)
+	}
 
-	collection := os.Getenv("COLLECTION_ADDRESS")
-	if collection == "" {
-		log.Println("⚠️ COLLECTION_ADDRESS не задан — индексатор не запущен")
-	} else {
-		go startCollectionIndexer(cb.RedisClient, collection)
+	// Периодическая сверка агрегатов индекса: INDEX_CHECK_INTERVAL, например 6h
+	if interval, err := time.ParseDuration(os.Getenv("INDEX_CHECK_INTERVAL")); err == nil && interval > 0 {
+		repair := os.Getenv("INDEX_CHECK_REPAIR") == "true"
+		for _, product := range botutils.Products() {
+			go botutils.CheckIndexPeriodically(cb.RedisClient, cb.Store, product, interval, repair)
+		}
 	}
 
-	go botutils.NotifyNewSales(bot, cb.RedisClient, collection)
+	log.Println("Бот запущен")
+	bot.Start()
+}
 
-	// Запуск /floor раз в 3 часа
-	go func() {
-		var msg *telebot.Message
-		for {
-			indexed, _ := cb.RedisClient.Get(botutils.Ctx, "collection:"+collection+":indexed").Result()
-			if indexed != "true" {
-				log.Println("[Floor] Первичная индексация ещё не завершена, ждём 30 секунд...")
-				time.Sleep(30 * time.Second)
-				continue
-			}
+// postFloorPeriodically публикует /floor продукта раз в 3 часа
+func postFloorPeriodically(bot *telebot.Bot, st botutils.Store, product *botutils.Product) {
+	collection := product.FragmentCollection
+	var msg *telebot.Message
+	var err error
+	for {
+		indexed, _ := st.Flag(botutils.Ctx, collection, "indexed")
+		if !indexed {
+			log.Printf("[Floor] %s: первичная индексация ещё не завершена, ждём 30 секунд...", product.ID)
+			time.Sleep(30 * time.Second)
+			continue
+		}
 
-			textMsg, imgPath := botutils.FloorCheck(cb.RedisClient)
+		textMsg, imgPath := botutils.FloorCheck(st, product)
 
-			if msg != nil {
-				bot.Delete(msg)
-			}
+		if msg != nil {
+			bot.Delete(msg)
+		}
 
-			adminID := os.Getenv("CHAT_ID")
-			threadID := os.Getenv("THREAD_ID")
-			chat := &telebot.Chat{ID: parseChatID(adminID)}
-			thread := parseThreadID(threadID)
-
-			if imgPath != "" {
-				photo := &telebot.Photo{File: telebot.FromDisk(imgPath)}
-				msg, err = bot.Send(chat, photo, &telebot.SendOptions{ThreadID: thread})
-				if err != nil {
-					log.Printf("Ошибка отправки /floor (картинка): %v", err)
-					bot.Send(chat, textMsg, &telebot.SendOptions{ThreadID: thread})
-				}
-			} else {
-				msg, err = bot.Send(chat, textMsg, &telebot.SendOptions{ThreadID: thread})
-				if err != nil {
-					log.Printf("Ошибка отправки /floor (текст): %v", err)
-				}
+		adminID := os.Getenv("CHAT_ID")
+		threadID := os.Getenv("THREAD_ID")
+		chat := &telebot.Chat{ID: parseChatID(adminID)}
+		thread := parseThreadID(threadID)
+
+		if imgPath != "" {
+			photo := &telebot.Photo{File: telebot.FromDisk(imgPath)}
+			msg, err = bot.Send(chat, photo, &telebot.SendOptions{ThreadID: thread})
+			if err != nil {
+				log.Printf("Ошибка отправки /floor (картинка): %v", err)
+				bot.Send(chat, textMsg, &telebot.SendOptions{ThreadID: thread})
+			}
+		} else {
+			msg, err = bot.Send(chat, textMsg, &telebot.SendOptions{ThreadID: thread})
+			if err != nil {
+				log.Printf("Ошибка отправки /floor (текст): %v", err)
 			}
-
-			time.Sleep(3 * time.Hour)
 		}
-	}()
 
-	log.Println("Бот запущен")
-	bot.Start()
+		time.Sleep(3 * time.Hour)
+	}
 }
 
 func parseChatID(s string) int64 {